@@ -0,0 +1,259 @@
+// The in-guest agent, dial out into the tunnel service and serve the vm services through the connection.
+// The vm don't need to be reachable from the tunnel service
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/agent"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
+	"golang.ngrok.com/muxado/v2"
+)
+
+const (
+	metadataURL    = "http://169.254.169.254/openstack/latest/meta_data.json"
+	reconnectDelay = 10 * time.Second
+	dialTimeout    = 10 * time.Second
+)
+
+var (
+	server  = flag.String("server", "", "The agent address of tunnel service, default from the vm tunnel_agent_server property")
+	token   = flag.String("token", "", "The agent token, default from the vm tunnel_agent_token property")
+	vmID    = flag.String("vm-id", "", "The vm id, default from the metadata service")
+	useTLS  = flag.Bool("tls", true, "Connect into the tunnel service with TLS, -tls=false only when the listener is plain text")
+	caFile  = flag.String("ca", "", "The CA file to verify the tunnel service certificate, default system CA")
+	ports   = flag.String("ports", "", "The local ports allowed to be served, e.g. 22,3389. Default the ports of the requested services from the vm tunnel_agent_ports property")
+	allowed []int
+)
+
+type metadata struct {
+	UUID string            `json:"uuid"`
+	Meta map[string]string `json:"meta"`
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+	allowed, err = agent.ParsePorts(*ports)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*useTLS {
+		log.Printf("!!! Connect into the tunnel service without TLS, the agent token and the vm traffic can be sniffed or hijacked !!!")
+	}
+
+	for {
+		err := connect()
+		log.Printf("Disconnected from tunnel service, reconnect in %v, %v", reconnectDelay, err)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+func connect() error {
+	// The token and server may be set after the vm booted, read them again on every reconnect
+	hello, addr, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	d := net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	if *useTLS {
+		tlsConfig, err := loadTLSConfig(addr)
+		if err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(&d, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+	} else {
+		conn, err = d.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+
+	err = agent.WriteJSON(conn, hello)
+	if err != nil {
+		return err
+	}
+
+	line, err := agent.ReadLine(conn)
+	if err != nil {
+		return err
+	}
+
+	var reply agent.HelloReply
+	if err := json.Unmarshal([]byte(line), &reply); err != nil {
+		return err
+	}
+
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+
+	log.Printf("Connected into tunnel service, server=%v id=%v", addr, hello.VMID)
+	session := muxado.Client(conn, nil)
+	defer session.Close()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serve(stream)
+	}
+}
+
+// Dial the local service requested by the tunnel service and join both connection
+func serve(stream net.Conn) {
+	defer stream.Close()
+
+	line, err := agent.ReadLine(stream)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	port, err := strconv.Atoi(line)
+	if err != nil || !slices.Contains(allowedPorts(), port) {
+		log.Printf("Port %v not allowed", line)
+		stream.Write([]byte(fmt.Sprintf("port %v not allowed\n", line)))
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", line), dialTimeout)
+	if err != nil {
+		log.Println(err)
+		stream.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	defer upstream.Close()
+
+	_, err = stream.Write([]byte(agent.StreamOK + "\n"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	relay.Join(stream, upstream)
+}
+
+// The ports from -ports, otherwise the ports of the requested services published by the tunnel service,
+// including the services from the tags and the image or flavor defaults. The property read on
+// every stream so the service added or removed later is followed without restart
+func allowedPorts() []int {
+	if len(allowed) > 0 {
+		return allowed
+	}
+
+	meta, err := loadMetadata()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	svcPorts, err := agent.ParsePorts(meta.Meta[config.AgentPortsMetadata])
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return svcPorts
+}
+
+func loadConfig() (agent.Hello, string, error) {
+	hello := agent.Hello{VMID: *vmID, Token: *token}
+	addr := *server
+	if hello.VMID != "" && hello.Token != "" && addr != "" {
+		return hello, addr, nil
+	}
+
+	meta, err := loadMetadata()
+	if err != nil {
+		return hello, addr, err
+	}
+
+	if hello.VMID == "" {
+		hello.VMID = meta.UUID
+	}
+	if hello.Token == "" {
+		hello.Token = meta.Meta[config.AgentTokenMetadata]
+	}
+	if addr == "" {
+		addr = meta.Meta[config.AgentServerMetadata]
+	}
+
+	if hello.Token == "" || addr == "" {
+		return hello, addr, fmt.Errorf("agent not enabled yet, set %v=true property on the vm", config.AgentMetadata)
+	}
+
+	return hello, addr, nil
+}
+
+func loadMetadata() (metadata, error) {
+	var meta metadata
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return meta, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return meta, fmt.Errorf("metadata service return %v", res.Status)
+	}
+
+	return meta, json.NewDecoder(res.Body).Decode(&meta)
+}
+
+func loadTLSConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	if *caFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(*caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %v", *caFile)
+	}
+	tlsConfig.RootCAs = pool
+
+	return tlsConfig, nil
+}
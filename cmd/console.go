@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/db"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/tunnel"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// The console token ttl is shorter than the scan, so the expiry checked on its own timer
+const consoleCheckInterval = 30 * time.Second
+
+func expireConsoles() {
+	for _, cloud := range clouds {
+		expireCloudConsoles(cloud)
+	}
+}
+
+// Stop the console tunnels whose token expired, the console only created again when requested again
+func expireCloudConsoles(cloud pkg.Cloud) {
+	computeClient, err := pkg.InitComputeClient(context.Background(), cloud)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+
+	updateDB := false
+	for index := len(tunnelVMs.Tunnels) - 1; index >= 0; index-- {
+		tunnelVM := &tunnelVMs.Tunnels[index]
+		if tunnelVM.GetCloud() != cloud || tunnelVM.Paused || tunnelVM.Kind != "" || !tunnelVM.ConsoleExpired() {
+			continue
+		}
+
+		// The deleted vm cleaned up by the scan
+		vm, err := getServer(computeClient, tunnelVM.VMID)
+		if err != nil {
+			Log.Error(err)
+			continue
+		} else if vm == nil {
+			continue
+		}
+
+		// Without the defaults the status of the default svc would be dropped, so retry on the next check
+		requested, err := tunnel.RequestedSvc(cloud, vm)
+		if err != nil {
+			Log.Error(err)
+			continue
+		}
+
+		Log.Infof("Console token expired, stop the console, name=%v id=%v", tunnelVM.VMname, tunnelVM.VMID)
+		keepSvc := slices.DeleteFunc(tunnelVM.GetVMSvc(), func(svc string) bool {
+			return svc == config.ConsoleService
+		})
+		_, err = tunnelVM.CheckRemovedSvc(keepSvc, tunnelVMs.TunProvider, computeClient, vm)
+		if err != nil {
+			Log.Error(err)
+			continue
+		}
+		updateDB = true
+
+		expiredErr := &tunnel.SvcError{Svc: config.ConsoleService, Status: tunnel.StatusExpired, Err: tunnel.ErrConsoleExpired}
+		updateStatus(computeClient, *vm, tunnelVM, requested, expiredErr)
+
+		// Only the console was tunneled
+		if len(tunnelVM.VMSvc) == 0 {
+			tunnelVMs.RemoveTunnelsByIndex(index)
+		}
+	}
+
+	if updateDB {
+		db.SaveTunnels(tunnelVMs.Tunnels)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/db"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/notification"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Reconcile single vm when nova notification received, so we don't need to wait the scheduler
+func reconcileVM(cloud pkg.Cloud, event notification.Event) {
+	Log.Debugf("Receive nova notification, event=%v id=%v cloud=%v", event.EventType, event.VMID, cloud)
+	computeClient, err := pkg.InitComputeClient(context.Background(), cloud)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+
+	vm, err := getServer(computeClient, event.VMID)
+	if err != nil {
+		Log.Errorf("Failed to get vm from notification, id=%v %v", event.VMID, err)
+		return
+	}
+
+	updateDB := false
+	if index := tunnelVMs.GetVMTunIndex(cloud, event.VMID); index >= 0 {
+		updateDB = checkTunnelVM(computeClient, index, vm, event.UserID)
+	} else if vm != nil {
+		updateDB = checkNewVM(computeClient, cloud, *vm, event.UserID)
+	}
+
+	if updateDB {
+		db.SaveTunnels(tunnelVMs.Tunnels)
+	}
+}
+
+// Get the server, nil if already deleted
+func getServer(computeClient *gophercloud.ServiceClient, vmID string) (*servers.Server, error) {
+	vm, err := servers.Get(context.Background(), computeClient, vmID).Extract()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	return vm, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/db"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// The host keys appear once cloud-init finished, the unchanged vm is not listed again until the full resync,
+// so the pending host keys polled on their own timer
+const hostKeyCheckInterval = 1 * time.Minute
+
+func checkHostKeys() {
+	for _, cloud := range clouds {
+		checkCloudHostKeys(cloud)
+	}
+}
+
+// Read the console log of the vms whose ssh host key not found yet
+func checkCloudHostKeys(cloud pkg.Cloud) {
+	computeClient, err := pkg.InitComputeClient(context.Background(), cloud)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+
+	updateDB := false
+	for index := range tunnelVMs.Tunnels {
+		tunnelVM := &tunnelVMs.Tunnels[index]
+		if tunnelVM.GetCloud() != cloud || tunnelVM.Paused || tunnelVM.Kind != "" || !tunnelVM.HostKeyPending() {
+			continue
+		}
+
+		// The deleted vm cleaned up by the scan
+		vm, err := getServer(computeClient, tunnelVM.VMID)
+		if err != nil {
+			Log.Error(err)
+			continue
+		} else if vm == nil {
+			continue
+		}
+
+		changed, err := tunnelVM.PublishSSHHostKeys(computeClient, *vm, tunnelVMs.TunProvider)
+		if err != nil {
+			Log.Error(err)
+		}
+		if changed {
+			updateDB = true
+		}
+	}
+
+	if updateDB {
+		db.SaveTunnels(tunnelVMs.Tunnels)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Get the user who requested the tunnel. The notification initiator is the user who changed
+// the property, otherwise fallback into the server owner since nova not record who changed the property.
+// The notification of our own property writes, e.g. the status, carry the service user so it is ignored
+func findRequester(cloud pkg.Cloud, vm servers.Server, initiator string) string {
+	if initiator == "" {
+		return vm.UserID
+	}
+
+	serviceUser, err := pkg.GetUserID(context.Background(), cloud)
+	if err != nil {
+		Log.Error(err)
+	}
+
+	if initiator == serviceUser {
+		return vm.UserID
+	}
+	return initiator
+}
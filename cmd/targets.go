@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/db"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/tunnel"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Sync the tunnels of the neutron ports and octavia load balancers with tunnel:<svc> tag.
+// Neutron and octavia have no changes-since, so the tagged targets always listed
+func checkCloudTargets(cloud pkg.Cloud) {
+	ctx := context.Background()
+	// Same as the servers, only the targets of the credential project unless all projects watched
+	projectID := ""
+	if !*allProjects {
+		var err error
+		projectID, err = pkg.GetProjectID(ctx, cloud)
+		if err != nil {
+			Log.Error(err)
+			return
+		}
+	}
+
+	targets, err := pkg.ListTaggedTargets(ctx, cloud, tunnel.RequestTargetTags(), projectID)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+
+	updateDB := false
+	seenTargets := map[string]bool{}
+	for index := range targets {
+		target := &targets[index]
+		seenTargets[target.ID] = true
+
+		err := tunnel.UpdateTargetErrors(cloud, target)
+		if err != nil {
+			Log.Error(err)
+		}
+
+		tunIndex := tunnelVMs.GetVMTunIndex(cloud, target.ID)
+		if tunIndex < 0 {
+			if checkNewTarget(cloud, target) {
+				updateDB = true
+			}
+			continue
+		}
+
+		if checkTunnelTarget(tunIndex, target) {
+			updateDB = true
+		}
+	}
+
+	// The target deleted or all tunnel tags removed
+	for index := len(tunnelVMs.Tunnels) - 1; index >= 0; index-- {
+		tun := tunnelVMs.Tunnels[index]
+		if tun.Kind != "" && tun.GetCloud() == cloud && !seenTargets[tun.VMID] && checkTunnelTarget(index, nil) {
+			updateDB = true
+		}
+	}
+
+	if updateDB {
+		db.SaveTunnels(tunnelVMs.Tunnels)
+	}
+}
+
+// Start the tunnel of new target, return true if the tunnel created
+func checkNewTarget(cloud pkg.Cloud, target *pkg.Target) bool {
+	listSvc := tunnel.RequestedTargetSvc(*target)
+	if len(listSvc) == 0 {
+		return false
+	}
+
+	Log.Infof("Found %v with tunnel tag, name=%v id=%v cloud=%v project=%v", target.Kind, target.Name, target.ID, cloud, target.ProjectID)
+	newTunnel := tunnel.NewTargetTunnel(cloud, *target)
+	// The failed svc retried on the next check
+	err := newTunnel.SetTargetSvc(listSvc, *target)
+	if err != nil {
+		Log.Error(err)
+		if len(newTunnel.VMSvc) == 0 {
+			return false
+		}
+	}
+
+	Prov := tunnelVMs.TunProvider
+	if Prov.NG.Active {
+		err := newTunnel.SetNgrok(&tunnelVMs.TunProvider.NG)
+		if err != nil {
+			Log.Error(err)
+			// Don't leave the half started forwarders running
+			err = newTunnel.StopNgrok(&tunnelVMs.TunProvider.NG, "")
+			if err != nil {
+				Log.Error(err)
+			}
+			return false
+		}
+	} else if Prov.CF.Active {
+		err := newTunnel.SetCloudFlare(Prov.CF, true)
+		if err != nil {
+			Log.Error(err)
+			// Don't leave the half created ingress and relays
+			err = newTunnel.StopCloudFlare(Prov.CF, "")
+			if err != nil {
+				Log.Error(err)
+			}
+			return false
+		}
+	} else {
+		Log.Fatal("tunnel provider not found")
+	}
+
+	err = newTunnel.PublishTargetEndpoints(Prov, target)
+	if err != nil {
+		Log.Error(err)
+	}
+
+	tunnelVMs.AppendTunnels([]tunnel.VmTunnel{newTunnel})
+	return true
+}
+
+// Sync the tunnel with the target tags, target is nil if the target deleted or no longer tagged.
+// Return true if the tunnel changed
+func checkTunnelTarget(index int, target *pkg.Target) bool {
+	Prov := tunnelVMs.TunProvider
+	tunnelTarget := &tunnelVMs.Tunnels[index]
+
+	if target == nil {
+		Log.Infof("Tagged %v not found, delete all tunnel, name=%v id=%v", tunnelTarget.Kind, tunnelTarget.VMname, tunnelTarget.VMID)
+		var err error
+		if Prov.NG.Active {
+			err = tunnelTarget.StopNgrok(&tunnelVMs.TunProvider.NG, "")
+		} else if Prov.CF.Active {
+			err = tunnelTarget.StopCloudFlare(Prov.CF, "")
+		}
+		if err != nil {
+			Log.Error(err)
+			return false
+		}
+
+		// The target still exist when only the tunnel tags removed
+		err = tunnelTarget.RemoveTargetEndpoints(Prov)
+		if err != nil {
+			Log.Error(err)
+		}
+
+		tunnelVMs.RemoveTunnelsByIndex(index)
+		return true
+	}
+
+	tunnelSvc := tunnel.RequestedTargetSvc(*target)
+	removedSvc, err := tunnelTarget.CheckRemovedTargetSvc(tunnelSvc, Prov, target)
+	if err != nil {
+		Log.Error(err)
+		return false
+	}
+
+	updatedSvc, err := tunnelTarget.CheckUpdatedTargetSvc(tunnelSvc, Prov, target)
+	if err != nil {
+		Log.Error(err)
+	}
+
+	// All svc removed, so the target no longer need a tunnel
+	if len(tunnelTarget.VMSvc) == 0 {
+		Log.Infof("%v tunnel tag removed, name=%v id=%v", tunnelTarget.Kind, tunnelTarget.VMname, tunnelTarget.VMID)
+		tunnelVMs.RemoveTunnelsByIndex(index)
+	}
+
+	return removedSvc != nil || updatedSvc != nil
+}
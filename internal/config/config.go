@@ -1,13 +1,58 @@
 package config
 
+import (
+	"net"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/dialer"
+)
+
 var (
-	ServiceID                map[string]int
+	NetworkPreference        []string
+	IPVersions               = []int{4, 6}
+	Netns                    bool
+	JumpRules                []dialer.Rule
+	SecGroupSource           *net.IPNet
+	SecGroupName             = "tunnel-service-%v"
+	NetworkMetadata          = "tunnel_network"
+	TunnelMetadata           = "tunnel"
+	TunnelDisabled           = "none"
+	TunnelDefaultProperty    = "tunnel_default"
+	TunnelTagPrefix          = "tunnel:"
+	TagsOnly                 bool
+	StatusMetadata           = "tunnel_status"
+	ErrorMetadata            = "tunnel_error_%v"
+	CheckedMetadata          = "tunnel_checked"
+	AgentMetadata            = "tunnel_agent"
+	AgentTokenMetadata       = "tunnel_agent_token"
+	AgentServerMetadata      = "tunnel_agent_server"
+	AgentPortsMetadata       = "tunnel_agent_ports"
 	NgrokTunnelMetadata      = "ngrok_endpoint_%v"
 	CloudflareTunnelMetadata = "cloudflare_endpoint_%v"
+	ProxyProtocolMetadata    = "tunnel_proxy_protocol"
+	ProxyProtocolSvcMetadata = "tunnel_proxy_protocol_%v"
+	SSHHostKeysMetadata      = "tunnel_ssh_hostkeys"
+	SSHKnownHostsMetadata    = "tunnel_ssh_known_hosts"
+	ConsoleService           = "console"
+	ConsoleProtocolMetadata  = "tunnel_console_protocol"
+	ConsoleExpiresMetadata   = "tunnel_console_expires"
+	ConsoleTTL               = 10 * time.Minute
+	EncryptedEndpoint        bool
+	ProxyProtoSupported      bool
+	InstanceID               string
 )
 
+// The svc port, shared with the agent
+var ServiceID = map[string]int{ // TODO
+	"ssh":   22,
+	"http":  80,
+	"https": 443,
+	"mysql": 3306,
+}
+
 const (
-	CFconfig   = "config.yaml"
-	TunnelName = "OpenStack_vm"
-	TunnelData = "TunnelsData.json"
+	CFconfig       = "config.yaml"
+	TunnelName     = "OpenStack_vm"
+	TunnelData     = "TunnelsData.json"
+	InstanceIDFile = "InstanceID"
 )
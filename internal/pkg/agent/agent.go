@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.ngrok.com/muxado/v2"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	maxLine          = 4096
+	StreamOK         = "ok"
+)
+
+var (
+	sessions   = map[string]muxado.Session{}
+	sessionsMu sync.Mutex
+)
+
+// First message from the agent, the token is hmac of the vm id so one secret serve all the vms
+type Hello struct {
+	VMID  string `json:"vm_id"`
+	Token string `json:"token"`
+}
+
+type HelloReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Accept the connections from the in-guest agents, every agent connection multiplexed into streams
+// and each stream is one upstream connection into the vm service
+type Server struct {
+	Secret string
+	// Address published into the vm, the agent dial into it
+	Addr string
+	// Called after the agent authenticated, used to start the tunnel without waiting the next scan
+	OnConnect func(vmID string)
+}
+
+// Generate the agent token of the vm
+func Token(secret, vmID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(vmID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Serve the agent connections until the listener closed
+func (i *Server) Serve(listener net.Listener) error {
+	log.Printf("Agent server started, listen=%v", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go i.handle(conn)
+	}
+}
+
+func (i *Server) handle(conn net.Conn) {
+	vmID, err := i.handshake(conn)
+	if err != nil {
+		log.Printf("Agent handshake failed, remote=%v %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	session := muxado.Server(conn, nil)
+
+	// The last connection win, the old one is stale after agent reconnect
+	sessionsMu.Lock()
+	if old, ok := sessions[vmID]; ok {
+		old.Close()
+	}
+	sessions[vmID] = session
+	sessionsMu.Unlock()
+
+	log.Printf("Agent connected, id=%v remote=%v", vmID, conn.RemoteAddr())
+	if i.OnConnect != nil {
+		go i.OnConnect(vmID)
+	}
+
+	// The agent never open stream, only wait until the session closed
+	session.Wait()
+
+	sessionsMu.Lock()
+	if sessions[vmID] == session {
+		delete(sessions, vmID)
+	}
+	sessionsMu.Unlock()
+
+	log.Printf("Agent disconnected, id=%v remote=%v", vmID, conn.RemoteAddr())
+}
+
+func (i *Server) handshake(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	line, err := ReadLine(conn)
+	if err != nil {
+		return "", err
+	}
+
+	var hello Hello
+	if err := json.Unmarshal([]byte(line), &hello); err != nil {
+		return "", err
+	}
+
+	var reply HelloReply
+	if hello.VMID == "" || !hmac.Equal([]byte(hello.Token), []byte(Token(i.Secret, hello.VMID))) {
+		reply.Error = "invalid token"
+	}
+
+	if err := WriteJSON(conn, reply); err != nil {
+		return "", err
+	}
+
+	if reply.Error != "" {
+		return "", fmt.Errorf("%v, id=%v", reply.Error, hello.VMID)
+	}
+
+	return hello.VMID, nil
+}
+
+// Check if the agent of the vm connected
+func Connected(vmID string) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	_, ok := sessions[vmID]
+	return ok
+}
+
+// Write the message as single json line
+func WriteJSON(conn net.Conn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// Dial the vm service through the agent, only the port is sent since the agent only dial the local services
+type Dialer struct {
+	VMID string
+}
+
+func (i *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("invalid port %v", port)
+	}
+
+	sessionsMu.Lock()
+	session, ok := sessions[i.VMID]
+	sessionsMu.Unlock()
+
+	if !ok {
+		return nil, errors.New("agent not connected")
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// The agent reply ok after the local service connected, otherwise the error
+	_, err = stream.Write([]byte(port + "\n"))
+	if err == nil {
+		var reply string
+		reply, err = ReadLine(stream)
+		if err == nil && reply != StreamOK {
+			err = fmt.Errorf("agent failed to dial port %v, %v", port, reply)
+		}
+	}
+
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	stream.SetDeadline(time.Time{})
+	return stream, nil
+}
+
+// Format the ports allowed to be served by the agent, e.g. 22,80
+func FormatPorts(ports []int) string {
+	var list []string
+	for _, port := range ports {
+		list = append(list, strconv.Itoa(port))
+	}
+	return strings.Join(list, ",")
+}
+
+// Parse the ports allowed to be served by the agent
+func ParsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %v", v)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// Read single line without buffering, the rest of the data belong to the service
+func ReadLine(conn net.Conn) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < maxLine {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, buf[0])
+	}
+
+	return "", errors.New("line too long")
+}
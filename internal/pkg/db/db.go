@@ -4,15 +4,25 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
 	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/tunnel"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
 )
 
 type VmTunnelJson struct {
-	VMname string         `json:"VMName"`
-	VMID   string         `json:"VMID"`
-	VMSvc  []tunnel.VmSvc `json:"VMSvc"`
+	VMname      string         `json:"VMName"`
+	VMID        string         `json:"VMID"`
+	Cloud       string         `json:"Cloud,omitempty"`
+	Region      string         `json:"Region,omitempty"`
+	TenantID    string         `json:"TenantID"`
+	UserID      string         `json:"UserID"`
+	VMSvc       []tunnel.VmSvc `json:"VMSvc"`
+	SecGroupID  string         `json:"SecGroupID,omitempty"`
+	Paused      bool           `json:"Paused,omitempty"`
+	Kind        string         `json:"Kind,omitempty"`
+	RequestedBy string         `json:"RequestedBy,omitempty"`
 }
 
 // saveTunnels saves the current tunnelVMs to a JSON file.
@@ -22,9 +32,17 @@ func SaveTunnels(Data []tunnel.VmTunnel) {
 	tunnelVMsJson := []VmTunnelJson{}
 	for _, v := range Data {
 		tunnelVMsJson = append(tunnelVMsJson, VmTunnelJson{
-			VMname: v.VMname,
-			VMID:   v.VMID,
-			VMSvc:  v.VMSvc,
+			VMname:      v.VMname,
+			VMID:        v.VMID,
+			Cloud:       v.Cloud,
+			Region:      v.Region,
+			TenantID:    v.TenantID,
+			UserID:      v.UserID,
+			VMSvc:       v.VMSvc,
+			SecGroupID:  v.SecGroupID,
+			Paused:      v.Paused,
+			Kind:        v.Kind,
+			RequestedBy: v.RequestedBy,
 		})
 	}
 
@@ -33,13 +51,21 @@ func SaveTunnels(Data []tunnel.VmTunnel) {
 		log.Fatal(err)
 	}
 
-	err = os.WriteFile(config.TunnelData, jsonData, 0644)
+	// The data has the project and user of the vms, keep it private
+	err = os.WriteFile(config.TunnelData, jsonData, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The file created by the older version is world readable
+	err = os.Chmod(config.TunnelData, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func LoadTunnels() []tunnel.VmTunnel {
+// Load the tunnels, the tunnels stored without cloud belong to the default cloud
+func LoadTunnels(defaultCloud pkg.Cloud) []tunnel.VmTunnel {
 	var Data []tunnel.VmTunnel
 	if _, err := os.Stat(config.TunnelData); err != nil {
 		SaveTunnels(Data) // Create file if it does not exist
@@ -57,12 +83,49 @@ func LoadTunnels() []tunnel.VmTunnel {
 	}
 
 	for index := range tunnelVMsJson {
+		if tunnelVMsJson[index].Cloud == "" && tunnelVMsJson[index].Region == "" && defaultCloud != (pkg.Cloud{}) {
+			log.Printf("Tunnel stored without cloud, move into the default cloud, name=%v id=%v cloud=%v", tunnelVMsJson[index].VMname, tunnelVMsJson[index].VMID, defaultCloud)
+			tunnelVMsJson[index].Cloud = defaultCloud.Name
+			tunnelVMsJson[index].Region = defaultCloud.Region
+		}
+
 		Data = append(Data, tunnel.VmTunnel{
-			VMname: tunnelVMsJson[index].VMname,
-			VMID:   tunnelVMsJson[index].VMID,
-			VMSvc:  tunnelVMsJson[index].VMSvc,
+			VMname:      tunnelVMsJson[index].VMname,
+			VMID:        tunnelVMsJson[index].VMID,
+			Cloud:       tunnelVMsJson[index].Cloud,
+			Region:      tunnelVMsJson[index].Region,
+			TenantID:    tunnelVMsJson[index].TenantID,
+			UserID:      tunnelVMsJson[index].UserID,
+			VMSvc:       tunnelVMsJson[index].VMSvc,
+			SecGroupID:  tunnelVMsJson[index].SecGroupID,
+			Paused:      tunnelVMsJson[index].Paused,
+			Kind:        tunnelVMsJson[index].Kind,
+			RequestedBy: tunnelVMsJson[index].RequestedBy,
 		})
 
 	}
 	return Data
 }
+
+// Load the instance id persisted alongside the tunnel data, the id is created on the first start.
+// The hostname used as the first id so the endpoints tagged by the older version still owned
+func LoadInstanceID() (string, error) {
+	data, err := os.ReadFile(config.InstanceIDFile)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	return id, SaveInstanceID(id)
+}
+
+func SaveInstanceID(id string) error {
+	log.Printf("Save instance id %v into %v", id, config.InstanceIDFile)
+	return os.WriteFile(config.InstanceIDFile, []byte(id+"\n"), 0600)
+}
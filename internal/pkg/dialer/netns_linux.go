@@ -0,0 +1,74 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Named network namespaces created by ip netns, neutron l3 and dhcp agents use the same path
+const netnsDir = "/var/run/netns"
+
+// Dial from inside the network namespace, e.g. qrouter-<router_id> or qdhcp-<network_id> on the neutron network node
+type Netns struct {
+	Name string
+}
+
+// Check if the network namespace exist on this host
+func NetnsExists(name string) bool {
+	_, err := os.Stat(filepath.Join(netnsDir, name))
+	return err == nil
+}
+
+func (i *Netns) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	// The namespace is per thread, the socket keep the namespace after the thread switched back.
+	// Dial in dedicated goroutine so the locked thread never leak into other goroutines
+	res := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		conn, restored, err := i.dial(ctx, network, address)
+		if restored {
+			runtime.UnlockOSThread()
+		}
+		// Thread not restored will be terminated together with the goroutine
+		res <- result{conn, err}
+	}()
+
+	r := <-res
+	return r.conn, r.err
+}
+
+func (i *Netns) dial(ctx context.Context, network, address string) (net.Conn, bool, error) {
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return nil, true, err
+	}
+	defer origin.Close()
+
+	target, err := os.Open(filepath.Join(netnsDir, i.Name))
+	if err != nil {
+		return nil, true, err
+	}
+	defer target.Close()
+
+	err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to enter netns %v, %v", i.Name, err)
+	}
+
+	d := net.Dialer{Timeout: Timeout}
+	conn, err := d.DialContext(ctx, network, address)
+
+	restored := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil
+	return conn, restored, err
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+type Netns struct {
+	Name string
+}
+
+func NetnsExists(name string) bool {
+	return false
+}
+
+func (i *Netns) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("network namespace only supported on linux")
+}
@@ -0,0 +1,102 @@
+package dialer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The route used to reach the vms of the project or network, empty project and network match all vms
+type Rule struct {
+	Project string
+	Network string
+	Via     string
+}
+
+// Parse the rules from "[project:<id>=|network:<name>=]<url>,..." format, e.g.
+// network:private=ssh://ubuntu@bastion:22,socks5://proxy:1080
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	if strings.TrimSpace(spec) == "" {
+		return rules, nil
+	}
+
+	for _, v := range strings.Split(spec, ",") {
+		var rule Rule
+		v = strings.TrimSpace(v)
+		if match, via, ok := strings.Cut(v, "="); ok {
+			kind, value, _ := strings.Cut(match, ":")
+			switch kind {
+			case "project":
+				rule.Project = value
+			case "network":
+				rule.Network = value
+			default:
+				return nil, fmt.Errorf("invalid route %q, match must be project:<id> or network:<name>", v)
+			}
+			v = via
+		}
+
+		// Make sure the via is valid before any vm use it
+		if _, err := Parse(v); err != nil {
+			return nil, err
+		}
+
+		rule.Via = v
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Find the via for the vm address, the network rule take precedence over the project rule then the default rule
+func MatchRule(rules []Rule, project, network string) string {
+	var projectVia, defaultVia string
+	for _, v := range rules {
+		switch {
+		case v.Network != "":
+			if v.Network == network {
+				return v.Via
+			}
+		case v.Project != "":
+			if v.Project == project && projectVia == "" {
+				projectVia = v.Via
+			}
+		default:
+			if defaultVia == "" {
+				defaultVia = v.Via
+			}
+		}
+	}
+
+	if projectVia != "" {
+		return projectVia
+	}
+	return defaultVia
+}
+
+// The via without the password, stored with the vm svc so the password stay only in the config
+func Ref(via string) string {
+	u, err := url.Parse(via)
+	if err != nil || u.User == nil {
+		return via
+	}
+
+	if _, ok := u.User.Password(); !ok {
+		return via
+	}
+
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// Resolve the stored via into the route of the rules with the password, the via
+// returned as is when no rule match e.g. the route removed from the config
+func Resolve(rules []Rule, via string) string {
+	for _, v := range rules {
+		if Ref(v.Via) == via {
+			return v.Via
+		}
+	}
+	return via
+}
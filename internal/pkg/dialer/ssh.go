@@ -0,0 +1,143 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	sshClients = map[string]*ssh.Client{}
+	sshMu      sync.Mutex
+)
+
+// Dial through the ssh jump host, the ssh connection shared by all the vms using the same jump host.
+// The private key from TUNNEL_SSH_KEY and host key verified with TUNNEL_SSH_KNOWN_HOSTS, default from ~/.ssh
+type SSH struct {
+	URL *url.URL
+}
+
+func (i *SSH) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := i.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil && !isOpenChannelError(err) {
+		// The ssh connection is broken, reconnect on next dial
+		i.reset(client)
+	}
+
+	return conn, err
+}
+
+func (i *SSH) client(ctx context.Context) (*ssh.Client, error) {
+	sshMu.Lock()
+	defer sshMu.Unlock()
+
+	key := i.URL.String()
+	if client, ok := sshClients[key]; ok {
+		return client, nil
+	}
+
+	config, err := sshClientConfig(i.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := i.URL.Host
+	if i.URL.Port() == "" {
+		addr = net.JoinHostPort(i.URL.Hostname(), "22")
+	}
+
+	d := net.Dialer{Timeout: Timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	log.Printf("Connected into ssh jump host, host=%v user=%v", addr, config.User)
+	client := ssh.NewClient(c, chans, reqs)
+	sshClients[key] = client
+
+	go func() {
+		client.Wait()
+		i.reset(client)
+	}()
+
+	return client, nil
+}
+
+func (i *SSH) reset(client *ssh.Client) {
+	sshMu.Lock()
+	defer sshMu.Unlock()
+
+	key := i.URL.String()
+	if sshClients[key] == client {
+		delete(sshClients, key)
+		client.Close()
+	}
+}
+
+func sshClientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+
+	keyFile := os.Getenv("TUNNEL_SSH_KEY")
+	if keyFile == "" {
+		keyFile = filepath.Join(home, ".ssh", "id_rsa")
+	}
+
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh key %v, %v", keyFile, err)
+	}
+
+	knownHostsFile := os.Getenv("TUNNEL_SSH_KNOWN_HOSTS")
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = "root"
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         Timeout,
+	}, nil
+}
+
+// The jump host reject the channel e.g. the vm port closed, the ssh connection still usable
+func isOpenChannelError(err error) bool {
+	var openErr *ssh.OpenChannelError
+	return errors.As(err, &openErr)
+}
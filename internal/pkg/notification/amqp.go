@@ -0,0 +1,269 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var reconnectDelay = 10 * time.Second
+
+// Nova notification event types which can change the vm tunnel
+var watchedEvents = []string{
+	"compute.instance.update",
+	"compute.instance.delete",
+	"compute.instance.create",
+	"instance.update",
+	"instance.delete",
+	"instance.create",
+	"compute.instance.power_on",
+	"compute.instance.power_off",
+	"compute.instance.suspend",
+	"compute.instance.resume",
+	"compute.instance.pause",
+	"compute.instance.unpause",
+	"compute.instance.shelve",
+	"compute.instance.unshelve",
+	"instance.power_on",
+	"instance.power_off",
+	"instance.suspend",
+	"instance.resume",
+	"instance.pause",
+	"instance.unpause",
+	"instance.shelve",
+	"instance.unshelve",
+	"compute.instance.rebuild",
+	"instance.rebuild",
+	"instance.interface_attach",
+	"instance.interface_detach",
+}
+
+// Consumer of oslo.messaging notifications from nova
+type Consumer struct {
+	URL      string
+	Exchange string
+	Topic    string
+	Queue    string
+	// Must match amqp_durable_queues of oslo.messaging, otherwise the exchange declare will fail
+	Durable bool
+	// Open the deliveries, the AMQP broker if nil
+	open        func() (*session, error)
+	mu          sync.Mutex
+	connectedAt time.Time
+}
+
+// The deliveries of one connection, closed receive the error when the connection lost
+type session struct {
+	msgs   <-chan amqp.Delivery
+	closed <-chan *amqp.Error
+	close  func()
+}
+
+type Event struct {
+	EventType string
+	VMID      string
+	// The user who made the request, empty if nova not send it
+	UserID string
+}
+
+// Consume the notifications until the context canceled, reconnect when the connection lost
+func (i *Consumer) Consume(ctx context.Context, handler func(Event)) {
+	for {
+		err := i.consume(ctx, handler)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("AMQP consumer stopped, reconnect in %v, %v", reconnectDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Return the time the consumer connected, zero while disconnected so the caller fallback into polling
+func (i *Consumer) ConnectedAt() time.Time {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.connectedAt
+}
+
+func (i *Consumer) setConnectedAt(t time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.connectedAt = t
+}
+
+func (i *Consumer) consume(ctx context.Context, handler func(Event)) error {
+	open := i.open
+	if open == nil {
+		open = i.dial
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	log.Printf("AMQP consumer started, exchange=%v topic=%v queue=%v", i.Exchange, i.Topic, i.Queue)
+	i.setConnectedAt(time.Now())
+	defer i.setConnectedAt(time.Time{})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-s.closed:
+			return err
+		case msg, ok := <-s.msgs:
+			if !ok {
+				return fmt.Errorf("AMQP delivery channel closed")
+			}
+			handle(msg, handler)
+		}
+	}
+}
+
+// The message acked once handled, the malformed one rejected without requeue since it never parsed
+func handle(msg amqp.Delivery, handler func(Event)) {
+	event, err := ParseNotification(msg.Body)
+	if err != nil {
+		log.Printf("Failed to parse notification, %v", err)
+		err = msg.Reject(false)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if event.VMID != "" && isWatched(event.EventType) {
+		handler(event)
+	}
+
+	err = msg.Ack(false)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (i *Consumer) dial() (*session, error) {
+	conn, err := amqp.Dial(i.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := i.subscribe(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (i *Consumer) subscribe(conn *amqp.Connection) (*session, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.ExchangeDeclare(i.Exchange, "topic", i.Durable, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Own queue so the notifications not stolen from other consumers like ceilometer
+	queue, err := ch.QueueDeclare(i.Queue, false, true, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, priority := range []string{"info", "error"} {
+		routingKey := fmt.Sprintf("%v.%v", i.Topic, priority)
+		err = ch.QueueBind(queue.Name, routingKey, i.Exchange, false, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msgs, err := ch.Consume(queue.Name, "", false, true, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The channel also closed with the connection, and alone by the broker e.g. on error
+	return &session{
+		msgs:   msgs,
+		closed: ch.NotifyClose(make(chan *amqp.Error, 1)),
+		close: func() {
+			ch.Close()
+			conn.Close()
+		},
+	}, nil
+}
+
+// Parse oslo.messaging notification, support both legacy and versioned nova notifications
+func ParseNotification(body []byte) (Event, error) {
+	var envelope struct {
+		OsloMessage string `json:"oslo.message"`
+	}
+
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return Event{}, err
+	}
+
+	// Message without envelope come from oslo.messaging v1
+	if envelope.OsloMessage != "" {
+		body = []byte(envelope.OsloMessage)
+	}
+
+	var msg struct {
+		EventType string `json:"event_type"`
+		// The request context only sent in the legacy notification
+		ContextUserID string `json:"_context_user_id"`
+		Payload       struct {
+			InstanceID string `json:"instance_id"`
+			NovaObject struct {
+				UUID                string `json:"uuid"`
+				ActionInitiatorUser string `json:"action_initiator_user"`
+			} `json:"nova_object.data"`
+		} `json:"payload"`
+	}
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return Event{}, err
+	}
+
+	event := Event{
+		EventType: msg.EventType,
+		VMID:      msg.Payload.InstanceID,
+		UserID:    msg.ContextUserID,
+	}
+
+	if event.VMID == "" {
+		event.VMID = msg.Payload.NovaObject.UUID
+	}
+
+	if event.UserID == "" {
+		event.UserID = msg.Payload.NovaObject.ActionInitiatorUser
+	}
+
+	return event, nil
+}
+
+func isWatched(eventType string) bool {
+	for _, v := range watchedEvents {
+		if strings.HasPrefix(eventType, v) {
+			return true
+		}
+	}
+	return false
+}
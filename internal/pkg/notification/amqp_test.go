@@ -0,0 +1,198 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseNotification(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name: "legacy notification",
+			body: `{"event_type": "compute.instance.update", "_context_user_id": "user-a", "payload": {"instance_id": "vm-1"}}`,
+			want: Event{EventType: "compute.instance.update", VMID: "vm-1", UserID: "user-a"},
+		},
+		{
+			name: "versioned notification",
+			body: `{"event_type": "instance.power_on.end", "payload": {"nova_object.data": {"uuid": "vm-2", "action_initiator_user": "user-b"}}}`,
+			want: Event{EventType: "instance.power_on.end", VMID: "vm-2", UserID: "user-b"},
+		},
+		{
+			name: "oslo v2 envelope",
+			body: `{"oslo.version": "2.0", "oslo.message": "{\"event_type\": \"instance.delete.end\", \"payload\": {\"nova_object.data\": {\"uuid\": \"vm-3\", \"action_initiator_user\": \"user-c\"}}}"}`,
+			want: Event{EventType: "instance.delete.end", VMID: "vm-3", UserID: "user-c"},
+		},
+		{
+			name: "context user take precedence over initiator",
+			body: `{"event_type": "instance.update", "_context_user_id": "user-a", "payload": {"nova_object.data": {"uuid": "vm-4", "action_initiator_user": "user-b"}}}`,
+			want: Event{EventType: "instance.update", VMID: "vm-4", UserID: "user-a"},
+		},
+		{
+			name: "without user",
+			body: `{"event_type": "compute.instance.delete.end", "payload": {"instance_id": "vm-5"}}`,
+			want: Event{EventType: "compute.instance.delete.end", VMID: "vm-5"},
+		},
+		{
+			name: "not a vm notification",
+			body: `{"event_type": "volume.create.end", "payload": {"volume_id": "vol-1"}}`,
+			want: Event{EventType: "volume.create.end"},
+		},
+		{
+			name:    "invalid json",
+			body:    `{"event_type": `,
+			wantErr: true,
+		},
+		{
+			name:    "invalid envelope message",
+			body:    `{"oslo.message": "not json"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNotification([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNotification() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseNotification() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsWatched(t *testing.T) {
+	tests := []struct {
+		eventType string
+		want      bool
+	}{
+		{"compute.instance.update", true},
+		{"instance.power_off.end", true},
+		{"compute.instance.shelve_offload.end", true},
+		{"instance.interface_attach.end", true},
+		{"volume.create.end", false},
+		{"compute.instance.exists", false},
+	}
+
+	for _, tt := range tests {
+		if got := isWatched(tt.eventType); got != tt.want {
+			t.Errorf("isWatched(%v) = %v, want %v", tt.eventType, got, tt.want)
+		}
+	}
+}
+
+type fakeAcker struct {
+	mu       sync.Mutex
+	acked    []uint64
+	rejected []uint64
+}
+
+func (i *fakeAcker) Ack(tag uint64, multiple bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.acked = append(i.acked, tag)
+	return nil
+}
+
+func (i *fakeAcker) Nack(tag uint64, multiple, requeue bool) error {
+	return nil
+}
+
+func (i *fakeAcker) Reject(tag uint64, requeue bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rejected = append(i.rejected, tag)
+	return nil
+}
+
+func TestConsumeReconnect(t *testing.T) {
+	reconnectDelay = time.Millisecond
+	acker := &fakeAcker{}
+	newSession := func(bodies ...string) (*session, chan *amqp.Error) {
+		msgs := make(chan amqp.Delivery, len(bodies))
+		for _, body := range bodies {
+			msgs <- amqp.Delivery{Acknowledger: acker, DeliveryTag: uint64(len(msgs) + 1), Body: []byte(body)}
+		}
+		closed := make(chan *amqp.Error, 1)
+		return &session{msgs: msgs, closed: closed, close: func() {}}, closed
+	}
+
+	first, firstClosed := newSession(
+		`{"event_type": `,
+		`{"event_type": "compute.instance.update", "payload": {"instance_id": "vm-1"}}`,
+	)
+	second, _ := newSession(
+		`{"event_type": "volume.create.end", "payload": {"volume_id": "vol-1"}}`,
+		`{"event_type": "instance.delete.end", "payload": {"nova_object.data": {"uuid": "vm-2"}}}`,
+	)
+
+	opened := 0
+	consumer := Consumer{
+		open: func() (*session, error) {
+			opened++
+			switch opened {
+			case 1:
+				return nil, errors.New("connection refused")
+			case 2:
+				return first, nil
+			default:
+				return second, nil
+			}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		consumer.Consume(ctx, func(event Event) {
+			if consumer.ConnectedAt().IsZero() {
+				t.Errorf("ConnectedAt() is zero while consuming")
+			}
+			events <- event
+		})
+		close(done)
+	}()
+
+	if got := <-events; got.VMID != "vm-1" {
+		t.Fatalf("first event = %+v, want vm-1", got)
+	}
+	firstClosed <- amqp.ErrClosed
+
+	if got := <-events; got.VMID != "vm-2" {
+		t.Fatalf("second event = %+v, want vm-2", got)
+	}
+	cancel()
+	<-done
+
+	if opened != 3 {
+		t.Errorf("opened %v sessions, want 3", opened)
+	}
+	if !consumer.ConnectedAt().IsZero() {
+		t.Errorf("ConnectedAt() = %v after stopped, want zero", consumer.ConnectedAt())
+	}
+
+	// The tag restart per session, the malformed message rejected and the others acked
+	acker.mu.Lock()
+	defer acker.mu.Unlock()
+	if want := []uint64{2, 1, 2}; !slices.Equal(acker.acked, want) {
+		t.Errorf("acked = %v, want %v", acker.acked, want)
+	}
+	if want := []uint64{1}; !slices.Equal(acker.rejected, want) {
+		t.Errorf("rejected = %v, want %v", acker.rejected, want)
+	}
+}
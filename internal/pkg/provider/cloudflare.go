@@ -177,8 +177,8 @@ func (i *CloudFlare) StopCFIngress(VMService string) error {
 	if err != nil {
 		return err
 	}
-	for index, ingress := range tunconf.Ingress {
-		if ingress.Service == VMService {
+	for index := len(tunconf.Ingress) - 1; index >= 0; index-- {
+		if tunconf.Ingress[index].Service == VMService {
 			tunconf.RemoveIngress(index)
 		}
 	}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -56,15 +57,52 @@ func (i *CloudFlare) AddTunnelDNS(dnsRec string) error {
 	return err
 }
 
-// TODO: Add deleting dns trough CF API
-/*
-	func (i *CloudFlare) DeletingTunnelDNS(dnsRec string) error {
-		client := i.CFapi.Client
-		Content := fmt.Sprintf("%v.%v", i.TunnelID, argoTunnel)
+// Check if the dns record already exist, e.g. the record kept by the previous process
+func IsDNSExists(err error) bool {
+	var apiErr *cloudflare.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, v := range apiErr.Errors {
+		// 81053 the host already has a record, 81057 the same record already exist
+		if v.Code == 81053 || v.Code == 81057 {
+			return true
+		}
+	}
+	return false
+}
 
+// Delete the tunnel dns record by the full hostname
+func (i *CloudFlare) DeleteTunnelDNS(hostname string) error {
+	client := i.CFapi.Client
+	page, err := client.DNS.Records.List(context.Background(), dns.RecordListParams{
+		ZoneID: cloudflare.F(i.CFapi.ZoneID),
+		Name: cloudflare.F(dns.RecordListParamsName{
+			Exact: cloudflare.F(hostname),
+		}),
+	})
+	if err != nil {
 		return err
 	}
-*/
+
+	Content := fmt.Sprintf("%v.%v", i.TunnelID, argoTunnel)
+	for _, v := range page.Result {
+		// Never touch the record not pointing into our tunnel
+		if v.Content != Content {
+			continue
+		}
+
+		_, err := client.DNS.Records.Delete(context.Background(), v.ID, dns.RecordDeleteParams{
+			ZoneID: cloudflare.F(i.CFapi.ZoneID),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
 // Read cf config file
 func ReadCloudFlareConfig() (TunnelConfig, error) {
@@ -2,38 +2,272 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
 	"golang.ngrok.com/ngrok/v2"
 )
 
-func (i *Ngrok) NgrokForwarder(vmEndpoint string, tunnelEndpoint *string) (ngrok.EndpointForwarder, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+const ngCloseTimeout = 10 * time.Second
 
-	i.NgrokCtx = append(i.NgrokCtx, NgCtx{
-		CtxCancel: cancel,
-		Ctx:       ctx,
-	})
+const (
+	ProxyProtoV1 = "v1"
+	ProxyProtoV2 = "v2"
+)
+
+// Check if the proxy protocol version supported by ngrok
+func ValidProxyProto(version string) bool {
+	return version == "" || version == ProxyProtoV1 || version == ProxyProtoV2
+}
+
+// Create one ngrok agent, all the forwarders will share the same agent session
+func (i *Ngrok) InitAgent(ctx context.Context, region string) error {
+	if region == "" {
+		region = "auto"
+	}
+
+	// Used to tag the endpoints so we know which endpoints belong to this instance,
+	// the instance id persisted so the endpoints still owned after restart or host rename
+	i.Owner = fmt.Sprintf("%v@%v", config.TunnelName, config.InstanceID)
+	i.Status = &NgrokStatus{
+		State:  "connecting",
+		Region: region,
+	}
+
+	opts := []ngrok.AgentOption{
+		ngrok.WithAuthtoken(os.Getenv("NGROK_AUTHTOKEN")),
+		ngrok.WithAgentDescription(config.TunnelName),
+		ngrok.WithEventHandler(i.Status.eventHandler),
+	}
 
+	if region != "auto" {
+		opts = append(opts, ngrok.WithAgentConnectURL(fmt.Sprintf("connect.%v.ngrok-agent.com:443", region)))
+	}
+
+	agent, err := ngrok.NewAgent(opts...)
+	if err != nil {
+		return err
+	}
+
+	i.Agent = agent
+
+	log.Printf("Connecting ngrok agent, region=%v", region)
+	return i.Agent.Connect(ctx)
+}
+
+// Start forwarding the vm endpoint and register the forwarder with vm id and svc as the key
+// The proxy protocol can be empty, v1 or v2
+func (i *Ngrok) NgrokForwarder(tunnelID, svc, vmEndpoint string, tunnelEndpoint *string, proxyProto string) (ngrok.EndpointForwarder, error) {
 	ngURL := "tcp://"
 	if tunnelEndpoint != nil {
 		ngURL += *tunnelEndpoint
 	}
 
-	vmEndpoint = fmt.Sprintf("tcp://%v", vmEndpoint)
-	a, err := ngrok.Forward(ctx, ngrok.WithUpstream(vmEndpoint), ngrok.WithURL(ngURL))
+	var upstreamOpts []ngrok.UpstreamOption
+	if proxyProto != "" {
+		upstreamOpts = append(upstreamOpts, ngrok.WithUpstreamProxyProto(ngrok.ProxyProtoVersion(proxyProto)))
+	}
+
+	return i.forward(tunnelID, svc, ngURL, fmt.Sprintf("tcp://%v", vmEndpoint), upstreamOpts...)
+}
+
+// Start forwarding the http upstream through the https endpoint with random domain, e.g. the console
+// which url carry the token so it must not be served in plain text
+func (i *Ngrok) NgrokHTTPSForwarder(tunnelID, svc, upstream string) (ngrok.EndpointForwarder, error) {
+	return i.forward(tunnelID, svc, "https://", fmt.Sprintf("http://%v", upstream))
+}
+
+func (i *Ngrok) forward(tunnelID, svc, ngURL, upstream string, upstreamOpts ...ngrok.UpstreamOption) (ngrok.EndpointForwarder, error) {
+	// Make sure there is only one live forwarder per vm svc
+	err := i.NgrokStop(tunnelID, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(NgEndpointMeta{
+		Owner:    i.Owner,
+		TunnelID: tunnelID,
+		Svc:      svc,
+		Upstream: upstream,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fwd, err := i.Agent.Forward(ctx,
+		ngrok.WithUpstream(upstream, upstreamOpts...),
+		ngrok.WithURL(ngURL),
+		ngrok.WithMetadata(string(meta)),
+		ngrok.WithDescription(fmt.Sprintf("%v %v %v", config.TunnelName, tunnelID, svc)),
+	)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	return a, nil
+	i.Forwarders.add(ngForwarderKey(tunnelID, svc), NgForwarder{
+		VMendpoint: upstream,
+		Forwarder:  fwd,
+		CtxCancel:  cancel,
+	})
+
+	return fwd, nil
+}
+
+// Stoping ngrok tunnel by closing the forwarder and wait until the endpoint done
+func (i *Ngrok) NgrokStop(tunnelID, svc string) error {
+	fwd, ok := i.Forwarders.remove(ngForwarderKey(tunnelID, svc))
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Close ngrok forwarder, id=%v svc=%v url=%v", tunnelID, svc, fwd.Forwarder.URL())
+	return fwd.close()
 }
 
-// Stoping ngrok tunnel by CtxCancel()
-func (i *Ngrok) NgrokStop(vmEndpoint string) {
-	for _, v := range i.NgrokCtx {
-		if vmEndpoint == v.VMendpoint {
-			v.CtxCancel()
+// Close all forwarders and disconnect the ngrok agent
+func (i *Ngrok) Shutdown() error {
+	for key, fwd := range i.Forwarders.removeAll() {
+		log.Printf("Close ngrok forwarder, key=%v url=%v", key, fwd.Forwarder.URL())
+		err := fwd.close()
+		if err != nil {
+			log.Println(err)
 		}
 	}
+
+	if i.Agent == nil {
+		return nil
+	}
+
+	log.Println("Disconnecting ngrok agent")
+	return i.Agent.Disconnect()
+}
+
+// Parse the endpoint metadata, return false if the endpoint not created by this instance
+func (i *Ngrok) ParseEndpointMeta(endpoint NgEndpoint) (NgEndpointMeta, bool) {
+	var meta NgEndpointMeta
+	if err := json.Unmarshal([]byte(endpoint.Metadata), &meta); err != nil {
+		return meta, false
+	}
+
+	return meta, meta.Owner == i.Owner
+}
+
+func ngForwarderKey(tunnelID, svc string) string {
+	return fmt.Sprintf("%v/%v", tunnelID, svc)
+}
+
+func NewNgForwarders() *NgForwarders {
+	return &NgForwarders{
+		forwarders: map[string]NgForwarder{},
+	}
+}
+
+func (i *NgForwarders) add(key string, fwd NgForwarder) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.forwarders[key] = fwd
+}
+
+func (i *NgForwarders) remove(key string) (NgForwarder, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fwd, ok := i.forwarders[key]
+	delete(i.forwarders, key)
+	return fwd, ok
+}
+
+func (i *NgForwarders) removeAll() map[string]NgForwarder {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	forwarders := i.forwarders
+	i.forwarders = map[string]NgForwarder{}
+	return forwarders
+}
+
+// Close the forwarder, cancel the running connection and wait until the endpoint done
+func (i NgForwarder) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ngCloseTimeout)
+	defer cancel()
+	defer i.CtxCancel()
+
+	err := i.Forwarder.CloseWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-i.Forwarder.Done():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timeout while waiting ngrok forwarder %v closed", i.Forwarder.URL())
+	}
+}
+
+// The event handler must not block, so only record the state here
+func (i *NgrokStatus) eventHandler(event ngrok.Event) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	switch e := event.(type) {
+	case *ngrok.EventAgentConnectSucceeded:
+		if i.State == "disconnected" {
+			i.Reconnects++
+		}
+		i.State = "connected"
+		i.ConnectedAt = e.Timestamp()
+		i.LastError = ""
+		log.Printf("Ngrok agent connected, region=%v reconnects=%v", i.Region, i.Reconnects)
+
+	case *ngrok.EventAgentDisconnected:
+		i.State = "disconnected"
+		if e.Error != nil {
+			i.LastError = e.Error.Error()
+		}
+		log.Printf("Ngrok agent disconnected, region=%v error=%v", i.Region, e.Error)
+
+	case *ngrok.EventAgentHeartbeatReceived:
+		i.Latency = e.Latency
+		i.LastHeartbeat = e.Timestamp()
+	}
+}
+
+// Get copy of the current agent status
+func (i *NgrokStatus) Get() NgrokStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return NgrokStatus{
+		State:         i.State,
+		Region:        i.Region,
+		Latency:       i.Latency,
+		ConnectedAt:   i.ConnectedAt,
+		LastHeartbeat: i.LastHeartbeat,
+		LastError:     i.LastError,
+		Reconnects:    i.Reconnects,
+	}
+}
+
+type NgEndpointMeta struct {
+	Owner    string `json:"owner"`
+	TunnelID string `json:"tunnel_id"`
+	Svc      string `json:"svc"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
+type NgrokStatus struct {
+	mu            sync.Mutex
+	State         string        `json:"state"`
+	Region        string        `json:"region"`
+	Latency       time.Duration `json:"latency"`
+	ConnectedAt   time.Time     `json:"connected_at"`
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+	LastError     string        `json:"last_error,omitempty"`
+	Reconnects    int           `json:"reconnects"`
 }
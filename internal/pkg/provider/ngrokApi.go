@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const ngrokAPI = "https://api.ngrok.com"
+
+// Init ngrok API, the api key is different with the agent authtoken
+func (i *Ngrok) InitAPI() {
+	i.APIKey = os.Getenv("NGROK_API_KEY")
+	i.StaticURLs = i.APIKey != ""
+}
+
+// Send request into ngrok API and decode the response into out
+func (i *Ngrok) apiRequest(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ngrokAPI+path, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+i.APIKey)
+	req.Header.Set("Ngrok-Version", "2")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("ngrok api %v %v failed, status=%v body=%s", method, path, res.StatusCode, msg)
+	}
+
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+
+	return nil
+}
+
+// Reserve new tcp address, https://dashboard.ngrok.com/tcp-addresses
+func (i *Ngrok) ReserveTCPAddr(description string) (ReservedAddr, error) {
+	var addr ReservedAddr
+	log.Printf("Reserve ngrok tcp address, description=%v", description)
+	err := i.apiRequest(context.Background(), http.MethodPost, "/reserved_addrs", map[string]string{
+		"description": description,
+	}, &addr)
+
+	return addr, err
+}
+
+// Description of the reserved tcp address, tagged with the owner so the leaked address can be found
+func (i *Ngrok) ReservedAddrDescription(tunnelID, svc string) string {
+	return fmt.Sprintf("%v %v %v", i.Owner, tunnelID, svc)
+}
+
+// Return false if the reserved tcp address not reserved by this instance
+func (i *Ngrok) IsReservedAddrOwned(addr ReservedAddr) bool {
+	owner, _, ok := strings.Cut(addr.Description, " ")
+	return ok && owner == i.Owner
+}
+
+// List all reserved tcp addresses in the ngrok account
+func (i *Ngrok) ListReservedAddrs() ([]ReservedAddr, error) {
+	var addrs []ReservedAddr
+	path := "/reserved_addrs"
+	for path != "" {
+		var page struct {
+			ReservedAddrs []ReservedAddr `json:"reserved_addrs"`
+			NextPageURI   string         `json:"next_page_uri"`
+		}
+
+		err := i.apiRequest(context.Background(), http.MethodGet, path, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, page.ReservedAddrs...)
+		path = strings.TrimPrefix(page.NextPageURI, ngrokAPI)
+	}
+
+	return addrs, nil
+}
+
+// Release the reserved tcp address
+func (i *Ngrok) ReleaseTCPAddr(id string) error {
+	log.Printf("Release ngrok tcp address, id=%v", id)
+	return i.apiRequest(context.Background(), http.MethodDelete, "/reserved_addrs/"+id, nil, nil)
+}
+
+// List all endpoints in the ngrok account
+func (i *Ngrok) ListEndpoints() ([]NgEndpoint, error) {
+	var endpoints []NgEndpoint
+	path := "/endpoints"
+	for path != "" {
+		var page struct {
+			Endpoints   []NgEndpoint `json:"endpoints"`
+			NextPageURI string       `json:"next_page_uri"`
+		}
+
+		err := i.apiRequest(context.Background(), http.MethodGet, path, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, page.Endpoints...)
+		path = strings.TrimPrefix(page.NextPageURI, ngrokAPI)
+	}
+
+	return endpoints, nil
+}
+
+// Stop the agent session which own the endpoint, agent endpoint can't be deleted directly
+func (i *Ngrok) StopTunnelSession(id string) error {
+	log.Printf("Stop ngrok tunnel session, id=%v", id)
+	return i.apiRequest(context.Background(), http.MethodPost, "/tunnel_sessions/"+id+"/stop", map[string]string{}, nil)
+}
+
+type NgEndpoint struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	URL           string `json:"url"`
+	PublicURL     string `json:"public_url"`
+	Hostport      string `json:"hostport"`
+	Metadata      string `json:"metadata"`
+	Description   string `json:"description"`
+	TunnelSession struct {
+		ID string `json:"id"`
+	} `json:"tunnel_session"`
+}
+
+type ReservedAddr struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	Description string `json:"description"`
+	Region      string `json:"region"`
+}
@@ -3,8 +3,10 @@ package provider
 import (
 	"context"
 	"os/exec"
+	"sync"
 
 	"github.com/cloudflare/cloudflare-go/v4"
+	"golang.ngrok.com/ngrok/v2"
 )
 
 type Provider struct {
@@ -15,13 +17,23 @@ type Provider struct {
 type Ngrok struct {
 	Active     bool
 	StaticURLs bool
-	NgrokCtx   []NgCtx
+	APIKey     string
+	Owner      string
+	Agent      ngrok.Agent
+	Status     *NgrokStatus
+	Forwarders *NgForwarders
 }
 
-type NgCtx struct {
+// Registry of the live ngrok forwarders, key is vm id and svc
+type NgForwarders struct {
+	mu         sync.Mutex
+	forwarders map[string]NgForwarder
+}
+
+type NgForwarder struct {
 	VMendpoint string
+	Forwarder  ngrok.EndpointForwarder
 	CtxCancel  context.CancelFunc
-	Ctx        context.Context
 }
 
 type CloudFlare struct {
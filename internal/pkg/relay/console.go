@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Local http relay in front of the nova console proxy. The websocket only forwarded with the console token
+// until the token expired, the host and origin rewritten so nova accept the browser from the public url
+type ConsoleRelay struct {
+	Upstream *url.URL
+	Token    string
+	Expires  time.Time
+	listener net.Listener
+	server   *http.Server
+	cancel   context.CancelFunc
+}
+
+// Start the console relay and register it with the key, same as Start
+func StartConsole(key, listenAddr string, r *ConsoleRelay) (string, error) {
+	// Make sure there is only one relay per key
+	err := Stop(key)
+	if err != nil {
+		return "", err
+	}
+
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return "", err
+	}
+	r.listener = listener
+
+	// The upgraded websocket not closed by the server, so close them by the request context
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.server = &http.Server{
+		Handler: r,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	relaysMu.Lock()
+	relays[key] = r
+	relaysMu.Unlock()
+
+	log.Printf("Start console relay, key=%v listen=%v upstream=%v expires=%v", key, listener.Addr(), r.Upstream.Host, r.Expires.Format(time.RFC3339))
+	go r.server.Serve(listener)
+
+	return listener.Addr().String(), nil
+}
+
+func (i *ConsoleRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if time.Now().After(i.Expires) {
+		http.Error(w, "console expired", http.StatusGone)
+		return
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The static novnc files have no token
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") && ConsoleToken(req.URL) != i.Token {
+		http.Error(w, "invalid console token", http.StatusForbidden)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(i.Upstream)
+			// Nova check the origin against the console proxy host
+			if r.Out.Header.Get("Origin") != "" {
+				r.Out.Header.Set("Origin", i.Upstream.Scheme+"://"+i.Upstream.Host)
+			}
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+func (i *ConsoleRelay) addr() net.Addr {
+	return i.listener.Addr()
+}
+
+func (i *ConsoleRelay) close() error {
+	i.cancel()
+	return i.server.Close()
+}
+
+// Get the console token from the url, the novnc url carry it inside the path parameter
+// e.g. vnc_lite.html?path=%3Ftoken%3Dabc, the websocket and spice url carry it directly
+func ConsoleToken(u *url.URL) string {
+	query := u.Query()
+	if token := query.Get("token"); token != "" {
+		return token
+	}
+
+	path, err := url.Parse(query.Get("path"))
+	if err != nil {
+		return ""
+	}
+	return path.Query().Get("token")
+}
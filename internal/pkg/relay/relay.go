@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/dialer"
+)
+
+const dialTimeout = 10 * time.Second
+
+var (
+	relays   = map[string]registered{}
+	relaysMu sync.Mutex
+)
+
+// The relay kinds share the same registry so the caller stop them by the key
+type registered interface {
+	addr() net.Addr
+	close() error
+}
+
+// Local tcp relay in front of the vm endpoint, used when the tunnel backend can't do the job by itself
+type Relay struct {
+	Upstream string
+	Dialer   dialer.Dialer
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Start the relay and register it with the key, the listen address can be empty to pick random port.
+// Return the address the relay listening on
+func Start(key, listenAddr string, r *Relay) (string, error) {
+	if r.Dialer == nil {
+		r.Dialer = &net.Dialer{Timeout: dialTimeout}
+	}
+
+	// Make sure there is only one relay per key
+	err := Stop(key)
+	if err != nil {
+		return "", err
+	}
+
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return "", err
+	}
+	r.listener = listener
+	r.done = make(chan struct{})
+
+	relaysMu.Lock()
+	relays[key] = r
+	relaysMu.Unlock()
+
+	log.Printf("Start relay, key=%v listen=%v upstream=%v", key, listener.Addr(), r.Upstream)
+	go r.serve()
+
+	return listener.Addr().String(), nil
+}
+
+// Stop the relay by key and wait the running connections closed
+func Stop(key string) error {
+	relaysMu.Lock()
+	r, ok := relays[key]
+	delete(relays, key)
+	relaysMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Stop relay, key=%v listen=%v", key, r.addr())
+	return r.close()
+}
+
+// Stop all the relays
+func StopAll() {
+	relaysMu.Lock()
+	keys := make([]string, 0, len(relays))
+	for key := range relays {
+		keys = append(keys, key)
+	}
+	relaysMu.Unlock()
+
+	for _, key := range keys {
+		err := Stop(key)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (i *Relay) serve() {
+	for {
+		conn, err := i.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+			i.handle(conn)
+		}()
+	}
+}
+
+func (i *Relay) handle(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	upstream, err := i.Dialer.DialContext(ctx, "tcp", i.Upstream)
+	if err != nil {
+		log.Printf("Relay failed to dial upstream %v, %v", i.Upstream, err)
+		return
+	}
+	defer upstream.Close()
+
+	// Close the connections when the relay stopped
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-i.done:
+			conn.Close()
+			upstream.Close()
+		case <-stop:
+		}
+	}()
+
+	Join(conn, upstream)
+}
+
+func (i *Relay) addr() net.Addr {
+	return i.listener.Addr()
+}
+
+func (i *Relay) close() error {
+	err := i.listener.Close()
+	close(i.done)
+
+	done := make(chan struct{})
+	go func() {
+		i.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(dialTimeout):
+		log.Printf("Timeout while waiting relay connections closed, listen=%v", i.listener.Addr())
+	}
+
+	return err
+}
+
+// Copy the data both way until one of the connection closed
+func Join(left, right net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go pipe(left, right)
+	go pipe(right, left)
+	wg.Wait()
+}
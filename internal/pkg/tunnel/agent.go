@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"slices"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/agent"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Publish the agent token, server address and the ports of the requested svc into the vm properties,
+// the agent read them from the metadata service. Only for the vm with tunnel_agent=true property
+func SetAgentProperty(cmp *gophercloud.ServiceClient, srv *agent.Server, vm servers.Server, listSvc []string) error {
+	if srv == nil || vm.Metadata[config.AgentMetadata] != "true" {
+		return nil
+	}
+
+	properties := map[string]string{
+		config.AgentTokenMetadata:  agent.Token(srv.Secret, vm.ID),
+		config.AgentServerMetadata: srv.Addr,
+		config.AgentPortsMetadata:  agentPorts(listSvc),
+	}
+
+	for key, value := range properties {
+		if vm.Metadata[key] == value {
+			continue
+		}
+
+		err := pkg.UpdateCmpProperty(cmp, vm, key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The ports of the svc, the tags and the image or flavor defaults are not visible from the metadata service
+// so the agent only know the requested svc from this property
+func agentPorts(listSvc []string) string {
+	var ports []int
+	for _, svc := range listSvc {
+		if port := config.ServiceID[svc]; port != 0 && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	slices.Sort(ports)
+	return agent.FormatPorts(ports)
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/agent"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+func TestAgentPorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		tags     []string
+		want     string
+	}{
+		{
+			name:     "tunnel property",
+			metadata: map[string]string{config.TunnelMetadata: "http,ssh"},
+			want:     "22,80",
+		},
+		{
+			name: "tag requested svc",
+			tags: []string{"tunnel:ssh", "tunnel:mysql", "owner:team-a"},
+			want: "22,3306",
+		},
+		{
+			name: "console has no port on the vm",
+			tags: []string{"tunnel:console", "tunnel:ssh"},
+			want: "22",
+		},
+		{
+			name:     "tunnel disabled",
+			metadata: map[string]string{config.TunnelMetadata: config.TunnelDisabled},
+			tags:     []string{"tunnel:ssh"},
+			want:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without image nor flavor the defaults never read from the cloud
+			vm := &servers.Server{ID: "vm-1", Metadata: tt.metadata, Tags: &tt.tags}
+			listSvc, err := RequestedSvc(pkg.Cloud{}, vm)
+			if err != nil {
+				t.Fatalf("RequestedSvc() error = %v", err)
+			}
+
+			got := agentPorts(listSvc)
+			if got != tt.want {
+				t.Fatalf("agentPorts(%v) = %v, want %v", listSvc, got, tt.want)
+			}
+
+			// The agent allow the same ports from the property
+			ports, err := agent.ParsePorts(got)
+			if err != nil {
+				t.Fatalf("ParsePorts(%v) error = %v", got, err)
+			}
+			for _, svc := range listSvc {
+				if port := config.ServiceID[svc]; port != 0 && !slices.Contains(ports, port) {
+					t.Errorf("port %v of %v not allowed by the agent, ports=%v", port, svc, ports)
+				}
+			}
+		})
+	}
+}
@@ -6,19 +6,37 @@ import (
 	"strings"
 
 	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
 )
 
 func (i *VmTunnel) SetCloudFlare(v provider.CloudFlare, dns bool) error {
 
 	for index, svc := range i.VMSvc {
-		knowPort := svc.VMEndpoint["WellKnownPorts"].(string)
-		vmEndpointRaw := svc.GetVMEndpoint()
-		vmEndpoint := fmt.Sprintf("%v://%v", knowPort, vmEndpointRaw)
+		// Skip the svc which already tunneled
+		if svc.TunnelEndpoint != nil {
+			continue
+		}
+
+		knowPort := svc.GetSvcName()
+
+		// The relay for the route and console
+		if i.VMSvc[index].needRelay() {
+			err := i.VMSvc[index].StartRelay(i.GetTunnelID())
+			if err != nil {
+				return err
+			}
+		}
+
+		vmEndpoint := i.VMSvc[index].GetCFService()
 
 		id := strings.Split(i.VMID, "-")[0]
 		prefix := v.SubDomainPrefix[knowPort]
 		domain := v.Domain
+		// Namespace the hostname per cloud region, so the same vm id never collide
 		sub := strings.Join([]string{id, prefix}, "-")
+		if ns := i.GetCloud().Namespace(); ns != "" {
+			sub = strings.Join([]string{sub, ns}, "-")
+		}
 		vmDns := fmt.Sprintf("%v.%v", sub, domain)
 
 		log.Printf("Start vm tunneling with CloudFlare, name=%v id=%v svc=%v hostname=%v", i.VMname, i.VMID, vmEndpoint, vmDns)
@@ -44,23 +62,76 @@ func (i *VmTunnel) SetCloudFlare(v provider.CloudFlare, dns bool) error {
 	return nil
 }
 
-// Stop the ngrok tunneling by Target vm endpoint or all tunneling if target vm endpoint is empty
-func (i *VmTunnel) StopCloudFlare(v provider.CloudFlare, TvmEndpoint string) error {
+// Stop the cloudflare tunneling by Target svc or all tunneling if target svc is empty
+func (i *VmTunnel) StopCloudFlare(v provider.CloudFlare, TSvc string) error {
 	for _, svc := range i.VMSvc {
-		vmEndpoint := svc.GetVMEndpoint()
-		if vmEndpoint == TvmEndpoint || TvmEndpoint == "" {
-			return v.StopCFIngress(vmEndpoint)
-			// TODO: Add func to delete the dns record
+		if svc.GetSvcName() == TSvc || TSvc == "" {
+			err := v.StopCFIngress(svc.GetCFService())
+			if err != nil {
+				return err
+			}
+
+			if svc.TunnelEndpoint != nil {
+				err = v.DeleteTunnelDNS(fmt.Sprintf("%v", svc.TunnelEndpoint["address"]))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = relay.Stop(svc.GetKey(i.GetTunnelID()))
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// The origin service of cloudflared ingress
+func (i *VmSvc) GetCFService() string {
+	// The console relay is plain http
+	if i.isConsole() {
+		return fmt.Sprintf("http://%v", i.GetUpstreamEndpoint())
+	}
+	return fmt.Sprintf("%v://%v", i.GetSvcName(), i.GetUpstreamEndpoint())
+}
+
 func (i *TunnelData) InitCFAPI() error {
 	return i.TunProvider.CF.InitAPI()
 }
 
+// Start the relays and cloudflared, the tunnel which relay failed is paused so the other tunnels still served
 func (i *TunnelData) InitCFTunnel() error {
-	return i.TunProvider.CF.InitTunnel()
+	var failed []*VmTunnel
+	for index := range i.Tunnels {
+		tun := &i.Tunnels[index]
+		if tun.Paused {
+			continue
+		}
+
+		for svcIndex := range tun.VMSvc {
+			svc := &tun.VMSvc[svcIndex]
+			if svc.needRelay() {
+				err := svc.StartRelay(tun.GetTunnelID())
+				if err != nil {
+					log.Printf("Failed to start relay, pause the tunnel until the next check, name=%v id=%v svc=%v %v", tun.VMname, tun.VMID, svc.GetSvcName(), err)
+					failed = append(failed, tun)
+					break
+				}
+			}
+		}
+	}
+
+	err := i.TunProvider.CF.InitTunnel()
+	if err != nil {
+		return err
+	}
+
+	// The ingress can only be removed once cloudflared started
+	for _, tun := range failed {
+		tun.pauseFailed(i.TunProvider)
+	}
+
+	return nil
 }
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// The console stopped once the token expired, the new token only created when requested again
+var ErrConsoleExpired = fmt.Errorf("console token expired, remove the %v property to request it again", config.ConsoleExpiresMetadata)
+
+// The console svc of the vm, the nova console proxy is the upstream instead of the vm
+func (i *VmTunnel) newConsoleSvc(metadata map[string]string) (VmSvc, error) {
+	if i.Kind != "" {
+		return VmSvc{}, fmt.Errorf("console only supported for the server")
+	}
+
+	// The token in the url give the console access, never publish it in plain text
+	if !config.EncryptedEndpoint {
+		return VmSvc{}, fmt.Errorf("console only published through the https endpoint")
+	}
+
+	if expires, err := time.Parse(time.RFC3339, metadata[config.ConsoleExpiresMetadata]); err == nil && time.Now().After(expires) {
+		return VmSvc{}, ErrConsoleExpired
+	}
+
+	protocol := metadata[config.ConsoleProtocolMetadata]
+	if protocol == "" {
+		protocol = "vnc"
+	}
+
+	svc := VmSvc{
+		VMEndpoint: map[string]any{
+			"WellKnownPorts": config.ConsoleService,
+			"protocol":       protocol,
+		},
+	}
+
+	err := i.createConsole(&svc)
+	if err != nil {
+		return VmSvc{}, err
+	}
+
+	return svc, nil
+}
+
+// Create the new nova remote console, the token valid until the nova token_ttl
+func (i *VmTunnel) createConsole(svc *VmSvc) error {
+	ctx := context.Background()
+	computeClient, err := pkg.InitComputeClient(ctx, i.GetCloud())
+	if err != nil {
+		return err
+	}
+
+	consoleURL, err := pkg.GetRemoteConsole(ctx, computeClient, i.VMID, fmt.Sprintf("%v", svc.VMEndpoint["protocol"]))
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(consoleURL)
+	if err != nil {
+		return err
+	}
+
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return err
+		}
+	}
+
+	svc.VMEndpoint["address"] = u.Hostname()
+	svc.VMEndpoint["port"] = port
+	svc.ConsoleURL = consoleURL
+	svc.ConsoleExpires = time.Now().Add(config.ConsoleTTL)
+	return nil
+}
+
+func (i *VmSvc) isConsole() bool {
+	return i.GetSvcName() == config.ConsoleService
+}
+
+func (i *VmSvc) startConsoleRelay(tunnelID string) error {
+	u, err := url.Parse(i.ConsoleURL)
+	if err != nil {
+		return err
+	}
+
+	relayEndpoint, err := relay.StartConsole(i.GetKey(tunnelID), i.RelayEndpoint, &relay.ConsoleRelay{
+		Upstream: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		Token:    relay.ConsoleToken(u),
+		Expires:  i.ConsoleExpires,
+	})
+	if err != nil {
+		return err
+	}
+
+	i.RelayEndpoint = relayEndpoint
+	return nil
+}
+
+// Check if the console token expired, the console is stopped until requested again
+func (i *VmTunnel) ConsoleExpired() bool {
+	for _, svc := range i.VMSvc {
+		if svc.isConsole() && time.Now().After(svc.ConsoleExpires) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write the console expiry into the vm property, removed when the console no longer requested.
+// The expired console keep the property so the console not created again until the property removed
+func (i *VmTunnel) UpdateConsoleProperty(cmp *gophercloud.ServiceClient, vm servers.Server, requested []string) error {
+	for _, svc := range i.VMSvc {
+		if !svc.isConsole() {
+			continue
+		}
+
+		expires := svc.ConsoleExpires.UTC().Format(time.RFC3339)
+		if vm.Metadata[config.ConsoleExpiresMetadata] == expires {
+			return nil
+		}
+		return pkg.UpdateCmpProperty(cmp, vm, config.ConsoleExpiresMetadata, expires)
+	}
+
+	if _, ok := vm.Metadata[config.ConsoleExpiresMetadata]; !ok || slices.Contains(requested, config.ConsoleService) {
+		return nil
+	}
+	return pkg.RemoveCmpProperty(cmp, vm.ID, config.ConsoleExpiresMetadata)
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+	"golang.org/x/crypto/ssh"
+)
+
+// Nova reject the property value longer than 255 characters
+const maxPropertyLen = 255
+
+// Stop reading the console log when cloud-init not print the keys since the vm launched
+const hostKeyTimeout = 30 * time.Minute
+
+// Publish the ssh host key fingerprints and the known_hosts line of the ssh endpoint into the vm properties.
+// The console log only read until the keys found, read again when the vm launched again e.g. after rebuild
+// or the tunnel_ssh_hostkeys property removed. Return true if the host key or the launch time changed
+func (i *VmTunnel) PublishSSHHostKeys(cmp *gophercloud.ServiceClient, vm servers.Server, v provider.Provider) (bool, error) {
+	index := slices.IndexFunc(i.VMSvc, func(svc VmSvc) bool {
+		return svc.GetSvcName() == "ssh"
+	})
+	if index < 0 {
+		return false, removeSSHHostKeys(cmp, vm)
+	}
+	svc := &i.VMSvc[index]
+
+	changed := false
+	launched := vmLaunchedAt(vm)
+	if !launched.Equal(i.LaunchedAt) {
+		// The key of the previous launch is stale, the tunnel from the older version has no launch time
+		if !i.LaunchedAt.IsZero() && svc.HostKey != "" {
+			log.Printf("VM launched again, read the ssh host key again, name=%v id=%v launched=%v", i.VMname, i.VMID, launched)
+			err := removeSSHHostKeys(cmp, vm)
+			if err != nil {
+				return false, err
+			}
+
+			vm.Metadata = maps.Clone(vm.Metadata)
+			delete(vm.Metadata, config.SSHHostKeysMetadata)
+			delete(vm.Metadata, config.SSHKnownHostsMetadata)
+			svc.HostKey = ""
+		}
+		i.LaunchedAt = launched
+		changed = true
+	}
+
+	// The image without cloud-init never print the keys
+	if svc.HostKey == "" && time.Since(launched) > hostKeyTimeout {
+		return changed, nil
+	}
+
+	if svc.HostKey == "" || vm.Metadata[config.SSHHostKeysMetadata] == "" {
+		hostKeys, err := pkg.GetConsoleHostKeys(context.Background(), cmp, vm.ID)
+		if err != nil {
+			return changed, err
+		}
+
+		// cloud-init not finished yet or the image without cloud-init
+		key := hostKeys.PreferredKey()
+		if key == nil {
+			return changed, nil
+		}
+
+		hostKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if hostKey != svc.HostKey {
+			log.Printf("Found ssh host key from console log, name=%v id=%v fingerprint=%v", i.VMname, i.VMID, ssh.FingerprintSHA256(key))
+			svc.HostKey = hostKey
+			changed = true
+		}
+
+		err = pkg.UpdateCmpProperty(cmp, vm, config.SSHHostKeysMetadata, joinProperty(hostKeys.Fingerprints))
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(svc.HostKey))
+	if err != nil {
+		return changed, err
+	}
+
+	line := pkg.KnownHostsLine(sshEndpoint(v, *svc), key)
+	if len(line) > maxPropertyLen {
+		return changed, fmt.Errorf("known_hosts line of %v too long for vm property", key.Type())
+	}
+
+	if vm.Metadata[config.SSHKnownHostsMetadata] == line {
+		return changed, nil
+	}
+
+	return changed, pkg.UpdateCmpProperty(cmp, vm, config.SSHKnownHostsMetadata, line)
+}
+
+// Check if the ssh host key still awaited from the console log, polled until found or the timeout
+func (i *VmTunnel) HostKeyPending() bool {
+	index := slices.IndexFunc(i.VMSvc, func(svc VmSvc) bool {
+		return svc.GetSvcName() == "ssh"
+	})
+	return index >= 0 && i.VMSvc[index].HostKey == "" && !i.LaunchedAt.IsZero() && time.Since(i.LaunchedAt) <= hostKeyTimeout
+}
+
+// The rebuild launch the vm again, the vm not launched yet use the create time
+func vmLaunchedAt(vm servers.Server) time.Time {
+	if vm.LaunchedAt.IsZero() {
+		return vm.Created
+	}
+	return vm.LaunchedAt
+}
+
+func removeSSHHostKeys(cmp *gophercloud.ServiceClient, vm servers.Server) error {
+	for _, key := range []string{config.SSHHostKeysMetadata, config.SSHKnownHostsMetadata} {
+		if _, ok := vm.Metadata[key]; !ok {
+			continue
+		}
+
+		err := pkg.RemoveCmpProperty(cmp, vm.ID, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The address which the ssh client connect, the cloudflare hostname used through cloudflared access on port 22
+func sshEndpoint(v provider.Provider, svc VmSvc) string {
+	if v.CF.Active {
+		return fmt.Sprintf("%v", svc.TunnelEndpoint["address"])
+	}
+	return svc.GetTunnelEndpoint()
+}
+
+// Join the values until the property limit
+func joinProperty(values []string) string {
+	property := ""
+	for _, value := range values {
+		next := value
+		if property != "" {
+			next = property + "," + value
+		}
+		if len(next) > maxPropertyLen {
+			break
+		}
+		property = next
+	}
+	return property
+}
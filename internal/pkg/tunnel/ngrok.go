@@ -4,83 +4,278 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
 
 	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
 	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
 	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
 )
 
 // Starting tunnel as ngrok backend
-func (i *VmTunnel) SetNgrok(v provider.Ngrok) error {
+func (i *VmTunnel) SetNgrok(v *provider.Ngrok) error {
 
 	for index, svc := range i.VMSvc {
-		vmEndpoint := svc.GetVMEndpoint()
+		// Skip the svc which already tunneled
+		if svc.TunnelEndpoint != nil {
+			continue
+		}
+
+		// The vm not reachable directly or the console, ngrok dial the relay which dial the upstream
+		if svc.needRelay() {
+			err := i.VMSvc[index].StartRelay(i.GetTunnelID())
+			if err != nil {
+				return err
+			}
+		}
+
+		// The console url short lived, so it get the random https domain instead of reserved address
+		reservedAddr := ""
+		if v.StaticURLs && !svc.isConsole() {
+			addr, err := v.ReserveTCPAddr(v.ReservedAddrDescription(i.GetTunnelID(), svc.GetSvcName()))
+			if err != nil {
+				return err
+			}
 
-		log.Printf("Start vm tunneling with Ngrok, name=%v id=%v svc=%v", i.VMname, i.VMID, vmEndpoint)
-		ngrokRes, err := v.NgrokForwarder(vmEndpoint, nil)
+			i.VMSvc[index].ReservedAddrID = addr.ID
+			reservedAddr = addr.Addr
+		}
+
+		log.Printf("Start vm tunneling with Ngrok, name=%v id=%v svc=%v proxy_protocol=%v", i.VMname, i.VMID, i.VMSvc[index].GetUpstreamEndpoint(), svc.ProxyProtocol)
+		err := i.VMSvc[index].ngrokForward(v, i.GetTunnelID(), reservedAddr)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// Start the ngrok forwarder and set the tunnel endpoint, the reserved address can be empty for random one.
+// The console url carry the token, so it is served through https
+func (i *VmSvc) ngrokForward(v *provider.Ngrok, tunnelID, reservedAddr string) error {
+	if i.isConsole() {
+		fwd, err := v.NgrokHTTPSForwarder(tunnelID, i.GetSvcName(), i.GetUpstreamEndpoint())
+		if err != nil {
+			return err
+		}
+
+		i.TunnelEndpoint = map[string]any{
+			"address": fwd.URL().Hostname(),
+			"port":    443,
+		}
+		return nil
+	}
+
+	var tunnelEndpoint *string
+	if reservedAddr != "" {
+		tunnelEndpoint = &reservedAddr
+	}
+
+	fwd, err := v.NgrokForwarder(tunnelID, i.GetSvcName(), i.GetUpstreamEndpoint(), tunnelEndpoint, i.ProxyProtocol)
+	if err != nil {
+		return err
+	}
 
-		res := ngrokRes.URL().Host
-		i.VMSvc[index].TunnelEndpoint = map[string]any{
-			"address": strings.Split(res, ":")[0],
-			"port": func() int {
-				num, err := strconv.Atoi(strings.Split(res, ":")[1])
+	return i.SetTunnelEndpoint(fwd.URL().Host)
+}
+
+// The reserved address of the svc, empty if not reserved
+func (i *VmSvc) reservedAddr() string {
+	if i.ReservedAddrID == "" {
+		return ""
+	}
+	return i.GetTunnelEndpoint()
+}
+
+// Stop the ngrok tunneling by Target svc or all tunneling if target svc is empty
+// the reserved tcp address also released since nobody will use it again
+func (i *VmTunnel) StopNgrok(v *provider.Ngrok, TSvc string) error {
+	for index, svc := range i.VMSvc {
+		svcName := svc.GetSvcName()
+		if svcName == TSvc || TSvc == "" {
+			err := v.NgrokStop(i.GetTunnelID(), svcName)
+			if err != nil {
+				return err
+			}
+
+			err = relay.Stop(svc.GetKey(i.GetTunnelID()))
+			if err != nil {
+				return err
+			}
+
+			if svc.ReservedAddrID != "" {
+				err := v.ReleaseTCPAddr(svc.ReservedAddrID)
 				if err != nil {
-					log.Fatalln(err)
+					return err
 				}
-				return num
-			}(),
+				i.VMSvc[index].ReservedAddrID = ""
+			}
 		}
 	}
 
 	return nil
 }
 
-// Stop the ngrok tunneling by Target vm endpoint or all tunneling if target vm endpoint is empty
-func (i *VmTunnel) StopNgrok(v provider.Ngrok, TvmEndpoint string) {
+// Check if all svc have reserved tcp address, the console never reserved
+func (i *VmTunnel) IsNgrokReserved() bool {
 	for _, svc := range i.VMSvc {
-		vmEndpoint := svc.GetVMEndpoint()
-		if vmEndpoint == TvmEndpoint || TvmEndpoint == "" {
-			v.NgrokStop(vmEndpoint)
+		if svc.ReservedAddrID == "" && !svc.isConsole() {
+			return false
+		}
+	}
+	return true
+}
+
+// Reconcile the endpoints in ngrok account with the tunnel data, endpoints from the previous
+// process may still alive and will block the static url from being used again.
+// The reserved addresses not in the tunnel data are released, e.g. crashed before the tunnel data saved
+func (i *TunnelData) ReconcileNGEndpoints() error {
+	NG := &i.TunProvider.NG
+	endpoints, err := NG.ListEndpoints()
+	if err != nil {
+		return err
+	}
+
+	stoppedSession := map[string]bool{}
+	for _, endpoint := range endpoints {
+		meta, owned := NG.ParseEndpointMeta(endpoint)
+		if !owned {
+			continue
+		}
+
+		svc := i.GetVMSvcByName(meta.TunnelID, meta.Svc)
+		if svc != nil && svc.ReservedAddrID != "" {
+			log.Printf("Stop ngrok endpoint of the previous process, started again with the same url, id=%v svc=%v url=%v", meta.TunnelID, meta.Svc, endpoint.URL)
+			if svc.GetTunnelEndpoint() != endpoint.Hostport {
+				log.Printf("Tunnel data not match with ngrok endpoint, update tunnel endpoint from %v to %v", svc.GetTunnelEndpoint(), endpoint.Hostport)
+				err := svc.SetTunnelEndpoint(endpoint.Hostport)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			log.Printf("Stop ngrok endpoint not in tunnel data, id=%v svc=%v url=%v", meta.TunnelID, meta.Svc, endpoint.URL)
 		}
+
+		// The old session must be stopped so the endpoint can be started again by this process
+		if endpoint.TunnelSession.ID != "" && !stoppedSession[endpoint.TunnelSession.ID] {
+			err := NG.StopTunnelSession(endpoint.TunnelSession.ID)
+			if err != nil {
+				return err
+			}
+			stoppedSession[endpoint.TunnelSession.ID] = true
+		}
+	}
+
+	return i.releaseUnusedNGAddrs()
+}
+
+// Release the reserved addresses of this instance which no svc use
+func (i *TunnelData) releaseUnusedNGAddrs() error {
+	NG := &i.TunProvider.NG
+	addrs, err := NG.ListReservedAddrs()
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	for _, tun := range i.Tunnels {
+		for _, svc := range tun.VMSvc {
+			used[svc.ReservedAddrID] = true
+		}
+	}
+
+	for _, addr := range addrs {
+		if !NG.IsReservedAddrOwned(addr) || used[addr.ID] {
+			continue
+		}
+
+		log.Printf("Ngrok reserved address not in tunnel data, id=%v addr=%v description=%v", addr.ID, addr.Addr, addr.Description)
+		err := NG.ReleaseTCPAddr(addr.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start the ngrok tunnel of the svc which already have reserved address
+func (i *VmTunnel) startNgrok(v *provider.Ngrok) error {
+	for svcIndex := range i.VMSvc {
+		svc := &i.VMSvc[svcIndex]
+		if svc.needRelay() {
+			err := svc.StartRelay(i.GetTunnelID())
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Starting %v", svc.GetTunnelEndpoint())
+		err := svc.ngrokForward(v, i.GetTunnelID(), svc.reservedAddr())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The tunnel failed to start, paused so it is resumed on the next check of the vm and the error written there
+func (i *VmTunnel) pauseFailed(v provider.Provider) {
+	err := i.Pause(v, false)
+	if err != nil {
+		log.Println(err)
 	}
+	i.Paused = true
 }
 
 func (i *TunnelData) InitNGCtx() {
 	if i.TunProvider.NG.Active {
-		if !i.TunProvider.NG.StaticURLs {
-			log.Printf("Ngrok static url is %v deleting all ngrok tunnels", i.TunProvider.NG.StaticURLs)
+		var keepTunnels []VmTunnel
+		for _, tun := range i.Tunnels {
+			// Without static url the old tunnel endpoint will never come back,
+			// same with the svc that created before static url was enabled
+			if i.TunProvider.NG.StaticURLs && tun.IsNgrokReserved() {
+				// Resumed once the vm started again
+				if tun.Paused {
+					keepTunnels = append(keepTunnels, tun)
+					continue
+				}
 
-			for index, tun := range i.Tunnels {
-				for _, svc := range tun.VMSvc {
-					ep := svc.GetTunnelEndpoint()
-					key := fmt.Sprintf(config.NgrokTunnelMetadata, svc.VMEndpoint["WellKnownPorts"].(string))
-					computeClient := pkg.InitComputeClient(context.Background())
-					log.Printf("Delete ngrok tunnel from vm property, name=%v id=%v svc=%v property=%v", tun.VMname, tun.VMID, ep, key)
-					pkg.RemoveCmpProperty(computeClient, tun.VMID, key)
+				log.Printf("Ngrok static url is %v starting ngrok tunnels, name=%v id=%v", i.TunProvider.NG.StaticURLs, tun.VMname, tun.VMID)
+				err := tun.startNgrok(&i.TunProvider.NG)
+				if err != nil {
+					log.Printf("Failed to start ngrok tunnel, pause the tunnel until the next check, name=%v id=%v %v", tun.VMname, tun.VMID, err)
+					tun.pauseFailed(i.TunProvider)
 				}
 
-				tun.StopNgrok(i.TunProvider.NG, "")
-				i.RemoveTunnelsByIndex(index)
+				keepTunnels = append(keepTunnels, tun)
+				continue
 			}
-		} else {
-			log.Printf("Ngrok static url is %v starting all ngrok tunnels", i.TunProvider.NG.StaticURLs)
-			for _, tun := range i.Tunnels {
-				for _, svc := range tun.VMSvc {
-					vmEndpoint := svc.GetVMEndpoint()
-					tunEndpoint := svc.GetTunnelEndpoint()
-					log.Printf("Starting %v", tunEndpoint)
 
-					_, err := i.TunProvider.NG.NgrokForwarder(vmEndpoint, &tunEndpoint)
+			log.Printf("Ngrok static url is %v deleting ngrok tunnels, name=%v id=%v", i.TunProvider.NG.StaticURLs, tun.VMname, tun.VMID)
+			computeClient, err := pkg.InitComputeClient(context.Background(), tun.GetCloud())
+			if err != nil {
+				log.Println(err)
+			} else {
+				for _, svc := range tun.VMSvc {
+					ep := svc.GetTunnelEndpoint()
+					key := fmt.Sprintf(config.NgrokTunnelMetadata, svc.GetSvcName())
+					log.Printf("Delete ngrok tunnel from vm property, name=%v id=%v svc=%v property=%v", tun.VMname, tun.VMID, ep, key)
+					err := pkg.RemoveCmpProperty(computeClient, tun.VMID, key)
 					if err != nil {
-						log.Fatal(err)
+						log.Println(err)
 					}
 				}
 			}
+
+			err = tun.StopNgrok(&i.TunProvider.NG, "")
+			if err != nil {
+				log.Println(err)
+			}
 		}
+
+		i.Tunnels = keepTunnels
 	}
 }
@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// The vm status which the service can't be reached until the vm started again
+var inactiveStatus = []string{"SHUTOFF", "SUSPENDED", "PAUSED", "SHELVED", "SHELVED_OFFLOADED"}
+
+func IsVMInactive(vm *servers.Server) bool {
+	return slices.Contains(inactiveStatus, vm.Status)
+}
+
+// Stop forwarding while the vm not running, the reserved address and hostname are kept
+// so the tunnel come back with the same endpoint
+func (i *VmTunnel) Pause(v provider.Provider, hideDNS bool) error {
+	log.Printf("Pause vm tunnel, name=%v id=%v", i.VMname, i.VMID)
+	for _, svc := range i.VMSvc {
+		if v.NG.Active {
+			err := v.NG.NgrokStop(i.GetTunnelID(), svc.GetSvcName())
+			if err != nil {
+				return err
+			}
+		} else if v.CF.Active {
+			err := v.CF.StopCFIngress(svc.GetCFService())
+			if err != nil {
+				return err
+			}
+
+			if hideDNS {
+				err := v.CF.DeleteTunnelDNS(fmt.Sprintf("%v", svc.TunnelEndpoint["address"]))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err := relay.Stop(svc.GetKey(i.GetTunnelID()))
+		if err != nil {
+			return err
+		}
+	}
+
+	i.Paused = true
+	return nil
+}
+
+// Start forwarding again after the vm started, ngrok without reserved address get new url.
+// When any svc failed the tunnel stay paused so it is resumed again on the next check
+func (i *VmTunnel) Resume(v provider.Provider, hideDNS bool) error {
+	log.Printf("Resume vm tunnel, name=%v id=%v", i.VMname, i.VMID)
+	err := i.resume(v, hideDNS)
+	if err != nil {
+		// Don't leave the half resumed svc running while paused
+		pauseErr := i.Pause(v, false)
+		if pauseErr != nil {
+			log.Println(pauseErr)
+		}
+		return err
+	}
+
+	i.Paused = false
+	return nil
+}
+
+func (i *VmTunnel) resume(v provider.Provider, hideDNS bool) error {
+	for index := range i.VMSvc {
+		svc := &i.VMSvc[index]
+		if v.NG.Active {
+			if svc.needRelay() {
+				err := svc.StartRelay(i.GetTunnelID())
+				if err != nil {
+					return err
+				}
+			}
+
+			err := svc.ngrokForward(&v.NG, i.GetTunnelID(), svc.reservedAddr())
+			if err != nil {
+				return err
+			}
+		} else if v.CF.Active {
+			if svc.needRelay() {
+				err := svc.StartRelay(i.GetTunnelID())
+				if err != nil {
+					return err
+				}
+			}
+
+			hostname := fmt.Sprintf("%v", svc.TunnelEndpoint["address"])
+			err := v.CF.AddCFIngress(hostname, svc.GetCFService())
+			if err != nil {
+				return err
+			}
+
+			// The record may survive the pause, e.g. deleting it failed or the pause-dns enabled after the pause
+			if hideDNS {
+				err := v.CF.AddTunnelDNS(hostname)
+				if err != nil && !provider.IsDNSExists(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Write the tunnel endpoints into the vm properties
+func (i *VmTunnel) UpdateEndpointProperty(cmp *gophercloud.ServiceClient, vm servers.Server, v provider.Provider) error {
+	metadataKey := config.CloudflareTunnelMetadata
+	if v.NG.Active {
+		metadataKey = config.NgrokTunnelMetadata
+	}
+
+	for _, svc := range i.VMSvc {
+		key := fmt.Sprintf(metadataKey, svc.GetSvcName())
+		if vm.Metadata[key] == svc.GetPublishedEndpoint() {
+			continue
+		}
+
+		err := pkg.UpdateCmpProperty(cmp, vm, key, svc.GetPublishedEndpoint())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Neutron need a moment to apply the new rule into the vm ports, the svc is checked again after it
+const SecGroupApplyDelay = 2 * time.Second
+
+// The svc is pending until the new rule applied, the caller check the vm again after SecGroupApplyDelay
+var ErrSecGroupApplying = errors.New("waiting the security group rule applied")
+
+// Allow the tunnel host into the svc port with the managed security group of the vm, return the rule id
+// or empty if the other vm security groups already allow it. The new rule return ErrSecGroupApplying with the rule id
+func (i *VmTunnel) allowSecGroup(svcPort int) (string, error) {
+	if config.SecGroupSource == nil {
+		return "", nil
+	}
+
+	ctx := context.Background()
+	networkClient, err := pkg.InitNetworkClient(ctx, i.GetCloud())
+	if err != nil {
+		return "", err
+	}
+
+	// The managed group skipped so the rule from the previous check is owned by the svc again
+	name := fmt.Sprintf(config.SecGroupName, i.VMID)
+	groupID, err := pkg.FindSecGroup(ctx, networkClient, i.TenantID, name)
+	if err != nil {
+		return "", err
+	}
+
+	allowed, err := pkg.SecGroupAllows(ctx, networkClient, i.VMID, svcPort, config.SecGroupSource, groupID)
+	if err != nil || allowed {
+		return "", err
+	}
+
+	computeClient, err := pkg.InitComputeClient(ctx, i.GetCloud())
+	if err != nil {
+		return "", err
+	}
+
+	groupID, err = pkg.EnsureSecGroup(ctx, networkClient, computeClient, i.VMID, i.TenantID, name)
+	if err != nil {
+		return "", err
+	}
+	i.SecGroupID = groupID
+
+	ruleID, created, err := pkg.CreateSecGroupRule(ctx, networkClient, groupID, svcPort, config.SecGroupSource)
+	if err != nil {
+		return "", err
+	}
+
+	if created {
+		log.Printf("Allow tunnel host into vm, name=%v id=%v port=%v source=%v", i.VMname, i.VMID, svcPort, config.SecGroupSource)
+		return ruleID, ErrSecGroupApplying
+	}
+	return ruleID, nil
+}
+
+// Delete the managed security group rule of the svc
+func (i *VmTunnel) RemoveSecGroupRule(svc VmSvc) error {
+	if svc.SecGroupRuleID == "" {
+		return nil
+	}
+
+	networkClient, err := pkg.InitNetworkClient(context.Background(), i.GetCloud())
+	if err != nil {
+		return err
+	}
+
+	return pkg.DeleteSecGroupRule(context.Background(), networkClient, svc.SecGroupRuleID)
+}
+
+// Detach and delete the managed security group when the vm no longer tunneled
+func (i *VmTunnel) RemoveSecGroup() error {
+	if i.SecGroupID == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	networkClient, err := pkg.InitNetworkClient(ctx, i.GetCloud())
+	if err != nil {
+		return err
+	}
+
+	computeClient, err := pkg.InitComputeClient(ctx, i.GetCloud())
+	if err != nil {
+		return err
+	}
+
+	err = pkg.DeleteSecGroup(ctx, networkClient, computeClient, i.VMID, i.SecGroupID)
+	if err != nil {
+		return err
+	}
+
+	i.SecGroupID = ""
+	return nil
+}
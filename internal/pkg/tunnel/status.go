@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+const (
+	StatusPending     = "pending"
+	StatusActive      = "active"
+	StatusPaused      = "paused"
+	StatusExpired     = "expired"
+	StatusUnreachable = "unreachable"
+	StatusFailed      = "failed"
+)
+
+// The worse svc status become the tunnel status
+var statusOrder = []string{StatusActive, StatusExpired, StatusPending, StatusUnreachable, StatusFailed}
+
+// Error of the svc which can't be tunneled, the other svc still tunneled
+type SvcError struct {
+	Svc    string
+	Status string
+	Err    error
+}
+
+func (e *SvcError) Error() string {
+	return fmt.Sprintf("%v %v, %v", e.Svc, e.Status, e.Err)
+}
+
+func (e *SvcError) Unwrap() error {
+	return e.Err
+}
+
+type SvcStatus struct {
+	Status string
+	Reason string
+}
+
+// Get the status of each requested svc from the error of the check. The error not from the svc,
+// e.g. the tunnel backend, fail all the svc not tunneled yet. The svc without error nor endpoint is pending
+func (i *VmTunnel) GetSvcStatus(requested []string, err error) map[string]SvcStatus {
+	svcErrs := map[string]*SvcError{}
+	var otherErrs []error
+	for _, e := range flattenErrors(err) {
+		var svcErr *SvcError
+		if errors.As(e, &svcErr) {
+			svcErrs[svcErr.Svc] = svcErr
+		} else if e != nil {
+			otherErrs = append(otherErrs, e)
+		}
+	}
+
+	status := map[string]SvcStatus{}
+	for _, svc := range requested {
+		if svcErr, ok := svcErrs[svc]; ok {
+			status[svc] = SvcStatus{Status: svcErr.Status, Reason: svcErr.Err.Error()}
+			continue
+		}
+
+		index := slices.IndexFunc(i.VMSvc, func(v VmSvc) bool {
+			return v.GetSvcName() == svc
+		})
+		if index >= 0 && i.VMSvc[index].TunnelEndpoint != nil {
+			status[svc] = SvcStatus{Status: StatusActive}
+		} else if otherErrs != nil {
+			status[svc] = SvcStatus{Status: StatusFailed, Reason: errors.Join(otherErrs...).Error()}
+		} else {
+			status[svc] = SvcStatus{Status: StatusPending}
+		}
+	}
+
+	return status
+}
+
+// Split the joined errors, the svc errors may be joined more than once e.g. by CheckUpdatedSvc
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
+
+// Check if the svc should be checked again without waiting the vm changed, the expired console
+// only created again when requested again
+func NeedRetry(svcStatus map[string]SvcStatus) bool {
+	for _, v := range svcStatus {
+		if v.Status == StatusPending || v.Status == StatusUnreachable || v.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail every svc of the tunnel with the error, e.g. the tunnel failed to start or resume
+func (i *VmTunnel) FailAllSvc(err error) error {
+	var errs []error
+	for _, svc := range i.GetVMSvc() {
+		errs = append(errs, &SvcError{Svc: svc, Status: StatusFailed, Err: err})
+	}
+	return errors.Join(errs...)
+}
+
+// Get the worst status of the svc
+func TunnelStatus(svcStatus map[string]SvcStatus) string {
+	status := StatusActive
+	for _, v := range svcStatus {
+		if slices.Index(statusOrder, v.Status) > slices.Index(statusOrder, status) {
+			status = v.Status
+		}
+	}
+	return status
+}
+
+// Write the tunnel_status and tunnel_error_<svc> properties, the active svc has no error property.
+// The properties only written when changed and the tunnel_checked only refreshed after the interval,
+// otherwise the changes-since poll would list the vm again on every cycle
+func UpdateStatusProperty(cmp *gophercloud.ServiceClient, vm servers.Server, status string, svcStatus map[string]SvcStatus, interval time.Duration) error {
+	properties := map[string]string{}
+	if vm.Metadata[config.StatusMetadata] != status {
+		properties[config.StatusMetadata] = status
+	}
+
+	errorKeys := map[string]bool{}
+	for svc, v := range svcStatus {
+		if v.Status == StatusActive {
+			continue
+		}
+
+		key := fmt.Sprintf(config.ErrorMetadata, svc)
+		errorKeys[key] = true
+
+		value := v.Status
+		if v.Reason != "" {
+			value = fmt.Sprintf("%v: %v", v.Status, v.Reason)
+		}
+		// Nova reject the property value longer than 255 characters
+		if len(value) > maxPropertyLen {
+			value = value[:maxPropertyLen]
+		}
+
+		if vm.Metadata[key] != value {
+			properties[key] = value
+		}
+	}
+
+	now := time.Now().UTC()
+	checked, err := time.Parse(time.RFC3339, vm.Metadata[config.CheckedMetadata])
+	if len(properties) > 0 || err != nil || now.Sub(checked) >= interval {
+		properties[config.CheckedMetadata] = now.Format(time.RFC3339)
+
+		err := pkg.UpdateCmpProperties(cmp, vm, properties)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The svc active again or no longer requested
+	for key := range vm.Metadata {
+		if isErrorProperty(key) && !errorKeys[key] {
+			err := pkg.RemoveCmpProperty(cmp, vm.ID, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove all the status properties when the tunnel request withdrawn
+func RemoveStatusProperty(cmp *gophercloud.ServiceClient, vm servers.Server) error {
+	for key := range vm.Metadata {
+		if key != config.StatusMetadata && key != config.CheckedMetadata && !isErrorProperty(key) {
+			continue
+		}
+
+		err := pkg.RemoveCmpProperty(cmp, vm.ID, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isErrorProperty(key string) bool {
+	return strings.HasPrefix(key, strings.TrimSuffix(config.ErrorMetadata, "%v"))
+}
@@ -0,0 +1,193 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// Tunnel of the neutron port or octavia load balancer, the target id used as vm id
+func NewTargetTunnel(cloud pkg.Cloud, target pkg.Target) VmTunnel {
+	return VmTunnel{
+		VMname:   target.Name,
+		VMID:     target.ID,
+		Cloud:    cloud.Name,
+		Region:   cloud.Region,
+		TenantID: target.ProjectID,
+		Kind:     target.Kind,
+	}
+}
+
+// The svc only served for the servers, e.g. the console from nova
+var serverOnlySvc = []string{config.ConsoleService}
+
+// Get the svc requested by the tunnel:<svc> tags of the target, the server only svc are reported by UpdateTargetErrors
+func RequestedTargetSvc(target pkg.Target) []string {
+	var listSvc []string
+	for _, tag := range target.Tags {
+		if svc, ok := strings.CutPrefix(tag, config.TunnelTagPrefix); ok && svc != "" && !slices.Contains(listSvc, svc) && !slices.Contains(serverOnlySvc, svc) {
+			listSvc = append(listSvc, svc)
+		}
+	}
+	return listSvc
+}
+
+// All the tags to list the targets, the error tags included so the error removed once the svc tag removed
+func RequestTargetTags() []string {
+	tags := RequestTags()
+	for _, svc := range serverOnlySvc {
+		tags = append(tags, unsupportedTargetTag(svc))
+	}
+	return tags
+}
+
+// Write the tunnel_error_<svc> tag for the server only svc requested by the target, removed once not requested
+func UpdateTargetErrors(cloud pkg.Cloud, target *pkg.Target) error {
+	for _, svc := range serverOnlySvc {
+		requested := slices.Contains(target.Tags, config.TunnelTagPrefix+svc)
+		if requested == slices.Contains(target.Tags, unsupportedTargetTag(svc)) {
+			continue
+		}
+
+		value := ""
+		if requested {
+			log.Printf("The %v svc only supported for servers, name=%v id=%v kind=%v", svc, target.Name, target.ID, target.Kind)
+			value = strings.TrimPrefix(unsupportedTargetTag(svc), targetErrorPrefix(svc))
+		}
+
+		err := pkg.SetTargetTag(context.Background(), cloud, target, targetErrorPrefix(svc), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The error tag is constant so it can be used to list the targets, neutron limit the tag into 60 characters
+func unsupportedTargetTag(svc string) string {
+	return targetErrorPrefix(svc) + StatusFailed + ": only supported for servers"
+}
+
+func targetErrorPrefix(svc string) string {
+	return fmt.Sprintf(config.ErrorMetadata, svc) + "="
+}
+
+// Set the svc of the target, the target has no property so the proxy protocol is not supported
+func (i *VmTunnel) SetTargetSvc(listSvc []string, target pkg.Target) error {
+	addrs := pkg.SortVMAddresses(target.Addrs, config.NetworkPreference, "", config.IPVersions)
+	if len(addrs) == 0 {
+		return fmt.Errorf("%v %v has no address", target.Kind, target.ID)
+	}
+
+	return i.setSvc(listSvc, addrs, nil)
+}
+
+// Publish the tunnel endpoints into the target tags, e.g. ngrok_endpoint_ssh=0.tcp.ngrok.io:12345
+func (i *VmTunnel) PublishTargetEndpoints(v provider.Provider, target *pkg.Target) error {
+	for _, svc := range i.VMSvc {
+		err := pkg.SetTargetTag(context.Background(), i.GetCloud(), target, targetTagPrefix(v, svc.GetSvcName()), svc.GetPublishedEndpoint())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop and remove the svc which no longer requested in the target tags
+func (i *VmTunnel) CheckRemovedTargetSvc(newSvc []string, v provider.Provider, target *pkg.Target) ([]string, error) {
+	diff := pkg.Difference(i.GetVMSvc(), newSvc)
+	if diff != nil {
+		log.Printf("Existing %v removed some tunnel tag, name=%v id=%v removed svc=%v", i.Kind, i.VMname, i.VMID, diff)
+		for _, removedSvc := range diff {
+			var err error
+			if v.NG.Active {
+				err = i.StopNgrok(&v.NG, removedSvc)
+			} else if v.CF.Active {
+				err = i.StopCloudFlare(v.CF, removedSvc)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			for index := len(i.VMSvc) - 1; index >= 0; index-- {
+				if i.VMSvc[index].GetSvcName() == removedSvc {
+					i.RemoveSvcByIndex(index)
+				}
+			}
+
+			err = pkg.SetTargetTag(context.Background(), i.GetCloud(), target, targetTagPrefix(v, removedSvc), "")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return diff, nil
+}
+
+// Start tunneling the svc which newly requested in the target tags
+func (i *VmTunnel) CheckUpdatedTargetSvc(newSvc []string, v provider.Provider, target *pkg.Target) ([]string, error) {
+	diff := pkg.Difference(newSvc, i.GetVMSvc())
+	if diff == nil {
+		return nil, nil
+	}
+
+	log.Printf("Existing %v update some tunnel tag, name=%v id=%v updated svc=%v", i.Kind, i.VMname, i.VMID, diff)
+	// The failed svc skipped and retried on the next check
+	svcErr := i.SetTargetSvc(diff, *target)
+
+	var err error
+	if v.NG.Active {
+		err = i.SetNgrok(&v.NG)
+	} else if v.CF.Active {
+		err = i.SetCloudFlare(v.CF, true)
+	}
+	if err != nil {
+		err = i.dropUntunneledSvc(v, err)
+	}
+
+	pubErr := i.PublishTargetEndpoints(v, target)
+	if pubErr != nil {
+		return nil, pubErr
+	}
+
+	var updated []string
+	for _, svc := range i.GetVMSvc() {
+		if slices.Contains(diff, svc) {
+			updated = append(updated, svc)
+		}
+	}
+
+	return updated, errors.Join(svcErr, err)
+}
+
+// Remove the endpoint tags when all the tunnel tags removed, the target deleted is ignored
+func (i *VmTunnel) RemoveTargetEndpoints(v provider.Provider) error {
+	ctx := context.Background()
+	target, err := pkg.GetTarget(ctx, i.GetCloud(), i.Kind, i.VMID)
+	if err != nil || target == nil {
+		return err
+	}
+
+	for _, svc := range i.VMSvc {
+		err := pkg.SetTargetTag(ctx, i.GetCloud(), target, targetTagPrefix(v, svc.GetSvcName()), "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func targetTagPrefix(v provider.Provider, svc string) string {
+	if v.CF.Active {
+		return fmt.Sprintf(config.CloudflareTunnelMetadata, svc) + "="
+	}
+	return fmt.Sprintf(config.NgrokTunnelMetadata, svc) + "="
+}
@@ -1,8 +1,16 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
@@ -17,14 +25,39 @@ type TunnelData struct {
 }
 
 type VmTunnel struct {
-	VMname string  `json:"VMName"`
-	VMID   string  `json:"VMID"`
-	VMSvc  []VmSvc `json:"VMSvc"`
+	VMname   string  `json:"VMName"`
+	VMID     string  `json:"VMID"`
+	Cloud    string  `json:"Cloud,omitempty"`
+	Region   string  `json:"Region,omitempty"`
+	TenantID string  `json:"TenantID"`
+	UserID   string  `json:"UserID"`
+	VMSvc    []VmSvc `json:"VMSvc"`
+	// The managed security group allow the tunnel host into the vm
+	SecGroupID string `json:"SecGroupID,omitempty"`
+	// The forwarding stopped while the vm not running, or failed to start so resumed on the next check
+	Paused bool `json:"Paused,omitempty"`
+	// The tunneled resource, port or loadbalancer, empty for the server
+	Kind string `json:"Kind,omitempty"`
+	// The user who made the last tunnel request change, for audit
+	RequestedBy string `json:"RequestedBy,omitempty"`
+	// The vm launch time which the ssh host key read for, changed by rebuild
+	LaunchedAt time.Time `json:"LaunchedAt,omitzero"`
 }
 
 type VmSvc struct {
 	TunnelEndpoint map[string]any `json:"TunnelEndpoint"`
 	VMEndpoint     map[string]any `json:"VMEndpoint"`
+	ReservedAddrID string         `json:"ReservedAddrID,omitempty"`
+	ProxyProtocol  string         `json:"ProxyProtocol,omitempty"`
+	RelayEndpoint  string         `json:"RelayEndpoint,omitempty"`
+	// The route to reach the vm when it is not directly reachable, e.g. netns:qrouter-<router_id>
+	Via            string `json:"Via,omitempty"`
+	SecGroupRuleID string `json:"SecGroupRuleID,omitempty"`
+	// The ssh host key from the vm console log, in authorized_keys format
+	HostKey string `json:"HostKey,omitempty"`
+	// The nova remote console url and the token expiry, only for the console svc
+	ConsoleURL     string    `json:"ConsoleURL,omitempty"`
+	ConsoleExpires time.Time `json:"ConsoleExpires,omitzero"`
 }
 
 func (i *VmTunnel) RemoveSvcByIndex(index int) {
@@ -39,52 +72,104 @@ func (i *TunnelData) AppendTunnels(newTunnel []VmTunnel) {
 	i.Tunnels = append(i.Tunnels, newTunnel...)
 }
 
-func (i *TunnelData) GetVMTun(vmID string) bool {
-	for _, v := range i.Tunnels {
-		if v.VMID == vmID {
-			return true
+// Get the index of vm tunnel in the cloud, return -1 if not found
+func (i *TunnelData) GetVMTunIndex(cloud pkg.Cloud, vmID string) int {
+	for index, v := range i.Tunnels {
+		if v.VMID == vmID && v.GetCloud() == cloud {
+			return index
 		}
 	}
-	return false
+	return -1
+}
+
+func (i *VmTunnel) GetCloud() pkg.Cloud {
+	return pkg.Cloud{
+		Name:   i.Cloud,
+		Region: i.Region,
+	}
+}
+
+// Unique id of the tunnel across the clouds, the vm id alone for the default cloud
+func (i *VmTunnel) GetTunnelID() string {
+	if i.Cloud == "" && i.Region == "" {
+		return i.VMID
+	}
+	return fmt.Sprintf("%v/%v", i.GetCloud(), i.VMID)
+}
+
+// Get the vm svc by tunnel id and svc name, return nil if not found
+func (i *TunnelData) GetVMSvcByName(tunnelID, svcName string) *VmSvc {
+	for index := range i.Tunnels {
+		if i.Tunnels[index].GetTunnelID() != tunnelID {
+			continue
+		}
+
+		for svcIndex := range i.Tunnels[index].VMSvc {
+			if i.Tunnels[index].VMSvc[svcIndex].GetSvcName() == svcName {
+				return &i.Tunnels[index].VMSvc[svcIndex]
+			}
+		}
+	}
+	return nil
 }
 
 func (i *VmTunnel) GetVMSvc() []string {
 	var vmSvcList []string
 	for _, v := range i.VMSvc {
-		vmSvcList = append(vmSvcList, v.VMEndpoint["WellKnownPorts"].(string))
+		vmSvcList = append(vmSvcList, v.GetSvcName())
 	}
 	return vmSvcList
 }
 
+// Stop and remove the svc which no longer requested in vm tunnel property
 func (i *VmTunnel) CheckRemovedSvc(newVMSvc []string, v provider.Provider, computeClient *gophercloud.ServiceClient, vm *servers.Server) ([]string, error) {
 	currentVMSvc := i.GetVMSvc()
-	diff := pkg.Difference(newVMSvc, currentVMSvc)
+	diff := pkg.Difference(currentVMSvc, newVMSvc)
 	if diff != nil {
 		log.Printf("Existing VM removed some tunnel property, name=%v id=%v removed svc=%v", i.VMname, i.VMID, diff)
 		for _, removedSvc := range diff {
-			removedPort := config.ServiceID[removedSvc]
-			for _, svc := range i.VMSvc {
-				if svc.VMEndpoint["port"].(int) == removedPort {
-					svcEndpoint := svc.GetVMEndpoint()
-					if v.NG.Active {
-						log.Printf("Stop ngrok tunnel, name=%v id=%v svc=%v", vm.Name, vm.ID, svcEndpoint)
-						v.NG.NgrokStop(svcEndpoint)
-						key := fmt.Sprintf(config.NgrokTunnelMetadata, removedSvc)
-						log.Printf("Delete ngrok tunnel from vm property, name=%v id=%v svc=%v property=%v", vm.Name, vm.ID, svcEndpoint, key)
-						pkg.RemoveCmpProperty(computeClient, i.VMID, key)
-
-					} else if v.CF.Active {
-						log.Printf("Stop cloduflare tunnel, name=%v id=%v svc=%v", vm.Name, vm.ID, svcEndpoint)
-						err := v.CF.StopCFIngress(svcEndpoint)
-						if err != nil {
-							return nil, nil
-						}
-
-						key := fmt.Sprintf(config.CloudflareTunnelMetadata, removedSvc)
-						log.Printf("Delete cloduflare tunnel from vm property, name=%v id=%v svc=%v property=%v", vm.Name, vm.ID, svcEndpoint, key)
-						pkg.RemoveCmpProperty(computeClient, i.VMID, key)
+			for index := len(i.VMSvc) - 1; index >= 0; index-- {
+				svc := i.VMSvc[index]
+				if svc.GetSvcName() != removedSvc {
+					continue
+				}
+
+				svcEndpoint := svc.GetVMEndpoint()
+				if v.NG.Active {
+					log.Printf("Stop ngrok tunnel, name=%v id=%v svc=%v", vm.Name, vm.ID, svcEndpoint)
+					err := i.StopNgrok(&v.NG, removedSvc)
+					if err != nil {
+						return nil, err
+					}
+
+					key := fmt.Sprintf(config.NgrokTunnelMetadata, removedSvc)
+					log.Printf("Delete ngrok tunnel from vm property, name=%v id=%v svc=%v property=%v", vm.Name, vm.ID, svcEndpoint, key)
+					err = pkg.RemoveCmpProperty(computeClient, i.VMID, key)
+					if err != nil {
+						return nil, err
+					}
+
+				} else if v.CF.Active {
+					log.Printf("Stop cloduflare tunnel, name=%v id=%v svc=%v", vm.Name, vm.ID, svcEndpoint)
+					err := i.StopCloudFlare(v.CF, removedSvc)
+					if err != nil {
+						return nil, err
+					}
+
+					key := fmt.Sprintf(config.CloudflareTunnelMetadata, removedSvc)
+					log.Printf("Delete cloduflare tunnel from vm property, name=%v id=%v svc=%v property=%v", vm.Name, vm.ID, svcEndpoint, key)
+					err = pkg.RemoveCmpProperty(computeClient, i.VMID, key)
+					if err != nil {
+						return nil, err
 					}
 				}
+
+				err := i.RemoveSecGroupRule(svc)
+				if err != nil {
+					return nil, err
+				}
+
+				i.RemoveSvcByIndex(index)
 			}
 		}
 	}
@@ -92,50 +177,251 @@ func (i *VmTunnel) CheckRemovedSvc(newVMSvc []string, v provider.Provider, compu
 	return diff, nil
 }
 
+// Start tunneling the svc which newly requested in vm tunnel property
 func (i *VmTunnel) CheckUpdatedSvc(newVMSvc []string, v provider.Provider, computeClient *gophercloud.ServiceClient, vm *servers.Server) ([]string, error) {
 	currentVMSvc := i.GetVMSvc()
-	diff := pkg.Difference(currentVMSvc, newVMSvc)
-	if diff != nil {
-		log.Printf("Existing VM update some tunnel property, name=%v id=%v updated svc=%v", i.VMname, i.VMID, diff)
-		err := i.SetVMSvc(diff, vm.Addresses)
-		if err != nil {
-			return nil, err
+	diff := pkg.Difference(newVMSvc, currentVMSvc)
+	if diff == nil {
+		return nil, nil
+	}
+
+	log.Printf("Existing VM update some tunnel property, name=%v id=%v updated svc=%v", i.VMname, i.VMID, diff)
+	// The failed svc skipped and retried on the next scan, the error returned after the other svc tunneled
+	svcErr := i.SetVMSvc(diff, vm)
+
+	var err error
+	metadataKey := ""
+	if v.NG.Active {
+		metadataKey = config.NgrokTunnelMetadata
+		err = i.SetNgrok(&v.NG)
+	} else if v.CF.Active {
+		metadataKey = config.CloudflareTunnelMetadata
+		err = i.SetCloudFlare(v.CF, true)
+	}
+
+	if err != nil {
+		err = i.dropUntunneledSvc(v, err)
+	}
+
+	var updated []string
+	for _, svc := range i.VMSvc {
+		if slices.Contains(diff, svc.GetSvcName()) {
+			updated = append(updated, svc.GetSvcName())
+			key := fmt.Sprintf(metadataKey, svc.GetSvcName())
+			err := pkg.UpdateCmpProperty(computeClient, *vm, key, svc.GetPublishedEndpoint())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return updated, errors.Join(svcErr, err)
+}
+
+// Stop and drop the svc which the backend failed to tunnel so they are retried on the next scan,
+// return the backend error of each svc for the status
+func (i *VmTunnel) dropUntunneledSvc(v provider.Provider, err error) error {
+	var errs []error
+	for index := len(i.VMSvc) - 1; index >= 0; index-- {
+		svc := i.VMSvc[index]
+		if svc.TunnelEndpoint != nil {
+			continue
 		}
 
+		var stopErr error
 		if v.NG.Active {
-			return diff, i.SetNgrok(v.NG)
+			stopErr = i.StopNgrok(&v.NG, svc.GetSvcName())
 		} else if v.CF.Active {
-			return diff, i.SetCloudFlare(v.CF, true)
+			stopErr = i.StopCloudFlare(v.CF, svc.GetSvcName())
+		}
+		if stopErr != nil {
+			log.Println(stopErr)
+		}
+
+		stopErr = i.RemoveSecGroupRule(svc)
+		if stopErr != nil {
+			log.Println(stopErr)
 		}
+
+		i.RemoveSvcByIndex(index)
+		errs = append(errs, &SvcError{Svc: svc.GetSvcName(), Status: StatusFailed, Err: err})
 	}
 
-	return diff, nil
+	return errors.Join(errs...)
 }
 
-func (i *VmTunnel) SetVMSvc(listSvc []string, ips map[string]any) error {
-	vmIPs := fmt.Sprintf("%v", ips)
-	for _, v := range listSvc {
-		svcPort := config.ServiceID[v]
-		if svcPort != 0 {
-			activeIPaddr, err := pkg.FindVMactiveIP(vmIPs, svcPort)
-			if err != nil {
-				return err
+// Get the svc requested by the vm, the tunnel property take precedence over the tunnel:<svc> tags
+// so the property can override the tags set by the tooling.
+// The default svc from the image and flavor always included, unless the vm disable it with tunnel=none.
+// When the defaults can't be read the requested svc still returned with the error, so they can be tunneled
+// but the default svc must not be removed as no longer requested
+func RequestedSvc(cloud pkg.Cloud, vm *servers.Server) ([]string, error) {
+	metaData := vm.Metadata[config.TunnelMetadata]
+	if metaData == config.TunnelDisabled {
+		return nil, nil
+	}
+
+	listSvc, err := defaultSvc(cloud, vm)
+	if err != nil {
+		err = fmt.Errorf("failed to get the default svc, name=%v id=%v %w", vm.Name, vm.ID, err)
+	}
+
+	var requested []string
+	if metaData != "" && !config.TagsOnly {
+		requested = strings.Split(metaData, ",")
+	} else if vm.Tags != nil {
+		for _, tag := range *vm.Tags {
+			if svc, ok := strings.CutPrefix(tag, config.TunnelTagPrefix); ok && svc != "" {
+				requested = append(requested, svc)
 			}
+		}
+	}
+
+	// Nova only list the tagged servers, so the defaults only apply with the tag to behave the same
+	// whether the vm listed or got by id
+	if config.TagsOnly && len(requested) == 0 {
+		return nil, nil
+	}
 
-			i.VMSvc = append(i.VMSvc, VmSvc{
-				VMEndpoint: map[string]any{
-					"WellKnownPorts": v,
-					"address":        activeIPaddr,
-					"port":           svcPort,
-				},
-			})
-		} else {
-			return fmt.Errorf("unsupported %v endpoint", v)
+	for _, svc := range requested {
+		if !slices.Contains(listSvc, svc) {
+			listSvc = append(listSvc, svc)
 		}
 	}
 
-	return nil
+	return listSvc, err
+}
+
+// Get the default svc from the tunnel_default image property and flavor extra spec
+func defaultSvc(cloud pkg.Cloud, vm *servers.Server) ([]string, error) {
+	var defaults []string
+	add := func(value string) {
+		for _, svc := range strings.Split(value, ",") {
+			if svc != "" && !slices.Contains(defaults, svc) {
+				defaults = append(defaults, svc)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	// The vm boot from volume has no image
+	if imageID, ok := vm.Image["id"].(string); ok && imageID != "" {
+		value, err := pkg.GetImageProperty(ctx, cloud, imageID, config.TunnelDefaultProperty)
+		if err != nil {
+			return nil, err
+		}
+		add(value)
+	}
+
+	if flavorID, ok := vm.Flavor["id"].(string); ok && flavorID != "" {
+		value, err := pkg.GetFlavorExtraSpec(ctx, cloud, flavorID, config.TunnelDefaultProperty)
+		if err != nil {
+			return nil, err
+		}
+		add(value)
+	}
+
+	return defaults, nil
+}
+
+// All the tags which request tunnel, used to filter the servers
+func RequestTags() []string {
+	var tags []string
+	for svc := range config.ServiceID {
+		tags = append(tags, config.TunnelTagPrefix+svc)
+	}
+	tags = append(tags, config.TunnelTagPrefix+config.ConsoleService)
+	slices.Sort(tags)
+	return tags
+}
 
+func (i *VmTunnel) SetVMSvc(listSvc []string, vm *servers.Server) error {
+	return i.setSvc(listSvc, vmAddresses(vm), vm.Metadata)
+}
+
+// Find the upstream of each svc from the addresses, the metadata is the vm property or nil for the target.
+// The svc which failed is skipped so the other svc still tunneled, the errors are *SvcError
+func (i *VmTunnel) setSvc(listSvc []string, vmAddrs []pkg.VMAddress, metadata map[string]string) error {
+	var errs []error
+	for _, v := range listSvc {
+		svc, err := i.newSvc(v, vmAddrs, metadata)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		i.VMSvc = append(i.VMSvc, svc)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (i *VmTunnel) newSvc(v string, vmAddrs []pkg.VMAddress, metadata map[string]string) (VmSvc, error) {
+	// The console served by nova, not by the vm
+	if v == config.ConsoleService {
+		svc, err := i.newConsoleSvc(metadata)
+		if errors.Is(err, ErrConsoleExpired) {
+			return VmSvc{}, &SvcError{Svc: v, Status: StatusExpired, Err: err}
+		} else if err != nil {
+			return VmSvc{}, &SvcError{Svc: v, Status: StatusFailed, Err: err}
+		}
+		return svc, nil
+	}
+
+	svcPort := config.ServiceID[v]
+	if svcPort == 0 {
+		return VmSvc{}, &SvcError{Svc: v, Status: StatusFailed, Err: fmt.Errorf("unsupported %v endpoint", v)}
+	}
+
+	// Per svc proxy protocol take precedence over the vm wide one
+	proxyProto := metadata[fmt.Sprintf(config.ProxyProtocolSvcMetadata, v)]
+	if proxyProto == "" {
+		proxyProto = metadata[config.ProxyProtocolMetadata]
+	}
+
+	if !provider.ValidProxyProto(proxyProto) {
+		return VmSvc{}, &SvcError{Svc: v, Status: StatusFailed, Err: fmt.Errorf("unsupported proxy protocol %v for %v endpoint", proxyProto, v)}
+	}
+
+	// cloudflared can't send the proxy protocol into the origin, the header from the relay would only carry
+	// the cloudflared address. Fail rather than the vm rejecting every connection without the header
+	if proxyProto != "" && !config.ProxyProtoSupported {
+		return VmSvc{}, &SvcError{Svc: v, Status: StatusFailed, Err: fmt.Errorf("proxy protocol only supported with ngrok")}
+	}
+
+	// The security group only managed for the server ports, the new rule kept while waiting it applied
+	ruleID := ""
+	if i.Kind == "" {
+		var err error
+		ruleID, err = i.allowSecGroup(svcPort)
+		if errors.Is(err, ErrSecGroupApplying) {
+			return VmSvc{}, &SvcError{Svc: v, Status: StatusPending, Err: err}
+		} else if err != nil {
+			return VmSvc{}, &SvcError{Svc: v, Status: StatusFailed, Err: err}
+		}
+	}
+
+	activeIPaddr, via, err := i.findUpstream(vmAddrs, svcPort)
+	if err != nil {
+		// Don't leave the rule of the svc which not tunneled
+		rmErr := i.RemoveSecGroupRule(VmSvc{SecGroupRuleID: ruleID})
+		if rmErr != nil {
+			log.Println(rmErr)
+		}
+		return VmSvc{}, &SvcError{Svc: v, Status: StatusUnreachable, Err: err}
+	}
+
+	return VmSvc{
+		VMEndpoint: map[string]any{
+			"WellKnownPorts": v,
+			"address":        activeIPaddr.Addr,
+			"port":           svcPort,
+			"network":        activeIPaddr.Network,
+			"version":        activeIPaddr.Version,
+		},
+		ProxyProtocol:  proxyProto,
+		Via:            via,
+		SecGroupRuleID: ruleID,
+	}, nil
 }
 
 func (i *VmTunnel) GetVMEndpoints() []string {
@@ -149,7 +435,7 @@ func (i *VmTunnel) GetVMEndpoints() []string {
 func (i *VmTunnel) GetTunnelEndpoints() []string {
 	var endPointList []string
 	for _, v := range i.VMSvc {
-		endPointList = append(endPointList, v.GetTunnelEndpoint())
+		endPointList = append(endPointList, v.GetPublishedEndpoint())
 	}
 	return endPointList
 }
@@ -158,11 +444,66 @@ func (i *VmSvc) GetTunnelEndpoint() string {
 	vmPort := i.TunnelEndpoint["port"]
 	vmActiveIP := i.TunnelEndpoint["address"]
 
-	return fmt.Sprintf("%v:%v", vmActiveIP, vmPort)
+	return net.JoinHostPort(fmt.Sprintf("%v", vmActiveIP), fmt.Sprintf("%v", vmPort))
+}
+
+// Get the endpoint published into the vm property, the console svc get the browser url with the token
+func (i *VmSvc) GetPublishedEndpoint() string {
+	if !i.isConsole() {
+		return i.GetTunnelEndpoint()
+	}
+
+	u, err := url.Parse(i.ConsoleURL)
+	if err != nil {
+		return i.GetTunnelEndpoint()
+	}
+
+	// The cloudflare hostname always served with https
+	if fmt.Sprintf("%v", i.TunnelEndpoint["port"]) == "443" {
+		return fmt.Sprintf("https://%v%v", i.TunnelEndpoint["address"], u.RequestURI())
+	}
+	return fmt.Sprintf("http://%v%v", i.GetTunnelEndpoint(), u.RequestURI())
+}
+
+// Set tunnel endpoint from host:port format
+func (i *VmSvc) SetTunnelEndpoint(hostport string) error {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+
+	num, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	i.TunnelEndpoint = map[string]any{
+		"address": host,
+		"port":    num,
+	}
+	return nil
 }
 
 func (i *VmSvc) GetVMEndpoint() string {
 	vmPort := i.VMEndpoint["port"]
 	vmActiveIP := i.VMEndpoint["address"]
-	return fmt.Sprintf("%v:%v", vmActiveIP, vmPort)
+	// The ipv6 address must be bracketed
+	return net.JoinHostPort(fmt.Sprintf("%v", vmActiveIP), fmt.Sprintf("%v", vmPort))
+}
+
+// Get the vm endpoint which the tunnel backend should use, the relay endpoint if the relay active
+func (i *VmSvc) GetUpstreamEndpoint() string {
+	if i.RelayEndpoint != "" {
+		return i.RelayEndpoint
+	}
+	return i.GetVMEndpoint()
+}
+
+// Key used to register the forwarder or relay of the svc
+func (i *VmSvc) GetKey(tunnelID string) string {
+	return fmt.Sprintf("%v/%v", tunnelID, i.GetSvcName())
+}
+
+func (i *VmSvc) GetSvcName() string {
+	return i.VMEndpoint["WellKnownPorts"].(string)
 }
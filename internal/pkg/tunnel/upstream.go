@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/config"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/agent"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/dialer"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/provider"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/relay"
+	"github.com/justhumanz/openstack-tunnel-as-service/pkg"
+)
+
+// The vm addresses by the preference order, the vm tunnel_network property override the network preference
+func vmAddresses(vm *servers.Server) []pkg.VMAddress {
+	network := vm.Metadata[config.NetworkMetadata]
+	return pkg.SortVMAddresses(pkg.ParseVMAddresses(vm.Addresses), config.NetworkPreference, network, config.IPVersions)
+}
+
+// Find the vm address which reachable for the svc port and the route to reach it.
+// The connected in-guest agent always used, otherwise try the direct connection first,
+// then the jump host or proxy of the project or network, then the neutron namespaces when running on the network node
+func (i *VmTunnel) findUpstream(vmAddrs []pkg.VMAddress, svcPort int) (pkg.VMAddress, string, error) {
+	if agent.Connected(i.VMID) {
+		// The agent dial the service on the vm loopback
+		via := "agent:" + i.VMID
+		d, _ := dialer.Parse(via)
+		addr, err := pkg.FindVMactiveIP(d, []pkg.VMAddress{{Network: "agent", Addr: "127.0.0.1", Version: 4, Type: "fixed"}}, svcPort)
+		return addr, via, err
+	}
+
+	direct, _ := dialer.Parse("")
+	addr, err := pkg.FindVMactiveIP(direct, vmAddrs, svcPort)
+	if err == nil {
+		return addr, "", nil
+	}
+
+	for _, vmAddr := range vmAddrs {
+		via := dialer.MatchRule(config.JumpRules, i.TenantID, vmAddr.Network)
+		if via == "" {
+			continue
+		}
+
+		d, derr := dialer.Parse(via)
+		if derr != nil {
+			log.Println(derr)
+			continue
+		}
+
+		_, derr = pkg.FindVMactiveIP(d, []pkg.VMAddress{vmAddr}, svcPort)
+		if derr == nil {
+			log.Printf("VM reachable through jump, name=%v id=%v address=%v via=%v", i.VMname, i.VMID, vmAddr.Addr, dialer.Redact(via))
+			return vmAddr, dialer.Ref(via), nil
+		}
+	}
+
+	if !config.Netns {
+		return addr, "", err
+	}
+
+	networkClient, nerr := pkg.InitNetworkClient(context.Background(), i.GetCloud())
+	if nerr != nil {
+		log.Println(nerr)
+		return addr, "", err
+	}
+
+	for _, vmAddr := range vmAddrs {
+		namespaces, nerr := pkg.FindVMNamespaces(context.Background(), networkClient, i.VMID, vmAddr)
+		if nerr != nil {
+			log.Println(nerr)
+			continue
+		}
+
+		for _, ns := range namespaces {
+			if !dialer.NetnsExists(ns) {
+				continue
+			}
+
+			_, nerr := pkg.FindVMactiveIP(&dialer.Netns{Name: ns}, []pkg.VMAddress{vmAddr}, svcPort)
+			if nerr == nil {
+				log.Printf("VM reachable through network namespace, name=%v id=%v address=%v netns=%v", i.VMname, i.VMID, vmAddr.Addr, ns)
+				return vmAddr, "netns:" + ns, nil
+			}
+		}
+	}
+
+	return addr, "", err
+}
+
+// Start the relay in front of the vm, reuse the old relay endpoint so the tunnel backend config still valid
+func (i *VmSvc) StartRelay(tunnelID string) error {
+	if i.isConsole() {
+		return i.startConsoleRelay(tunnelID)
+	}
+
+	// The stored via has no password, the credentials come from the config at dial time.
+	// The via stored by the older version still has it, so drop it on the next save
+	d, err := dialer.Parse(dialer.Resolve(config.JumpRules, i.Via))
+	if err != nil {
+		return err
+	}
+	i.Via = dialer.Ref(i.Via)
+
+	relayEndpoint, err := relay.Start(i.GetKey(tunnelID), i.RelayEndpoint, &relay.Relay{
+		Upstream: i.GetVMEndpoint(),
+		Dialer:   d,
+	})
+	if err != nil {
+		return err
+	}
+
+	i.RelayEndpoint = relayEndpoint
+	return nil
+}
+
+// The relay needed when the vm reached through the route or the console
+func (i *VmSvc) needRelay() bool {
+	return i.Via != "" || i.isConsole()
+}
+
+// Resolve the upstream again when the vm address of the svc is gone, e.g. after rebuild or port swap.
+// The ngrok upstream or cloudflared ingress repointed in place so the public endpoint stay the same,
+// except ngrok without reserved address which get new url. Return true if any svc repointed
+func (i *VmTunnel) CheckAddressChanged(v provider.Provider, vm *servers.Server) (bool, error) {
+	vmAddrs := vmAddresses(vm)
+
+	changed := false
+	for index := range i.VMSvc {
+		svc := &i.VMSvc[index]
+		// The agent always dial the vm loopback and the console is not on the vm
+		if svc.isConsole() || strings.HasPrefix(svc.Via, "agent:") || hasAddress(vmAddrs, fmt.Sprintf("%v", svc.VMEndpoint["address"])) {
+			continue
+		}
+
+		addr, via, err := i.findUpstream(vmAddrs, config.ServiceID[svc.GetSvcName()])
+		if err != nil {
+			return changed, err
+		}
+
+		log.Printf("VM address changed, name=%v id=%v svc=%v from=%v to=%v", i.VMname, i.VMID, svc.GetSvcName(), svc.VMEndpoint["address"], addr.Addr)
+		err = i.repoint(v, svc, addr, via)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (i *VmTunnel) repoint(v provider.Provider, svc *VmSvc, addr pkg.VMAddress, via string) error {
+	oldUpstream := svc.GetUpstreamEndpoint()
+	oldService := svc.GetCFService()
+
+	svc.VMEndpoint["address"] = addr.Addr
+	svc.VMEndpoint["network"] = addr.Network
+	svc.VMEndpoint["version"] = addr.Version
+	svc.Via = via
+
+	// The relay keep the same listen address, so the backend pointing into it need nothing
+	if svc.needRelay() {
+		err := svc.StartRelay(i.GetTunnelID())
+		if err != nil {
+			return err
+		}
+	} else if svc.RelayEndpoint != "" {
+		err := relay.Stop(svc.GetKey(i.GetTunnelID()))
+		if err != nil {
+			return err
+		}
+		svc.RelayEndpoint = ""
+	}
+
+	if svc.GetUpstreamEndpoint() == oldUpstream {
+		return nil
+	}
+
+	if v.NG.Active {
+		return svc.ngrokForward(&v.NG, i.GetTunnelID(), svc.reservedAddr())
+	} else if v.CF.Active {
+		err := v.CF.StopCFIngress(oldService)
+		if err != nil {
+			return err
+		}
+
+		return v.CF.AddCFIngress(fmt.Sprintf("%v", svc.TunnelEndpoint["address"]), svc.GetCFService())
+	}
+
+	return nil
+}
+
+func hasAddress(vmAddrs []pkg.VMAddress, address string) bool {
+	for _, v := range vmAddrs {
+		if v.Addr == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Address of the vm from nova addresses, https://docs.openstack.org/api-ref/compute/#show-server-details
+type VMAddress struct {
+	Network string
+	Addr    string
+	Version int
+	Type    string // fixed or floating
+}
+
+// Parse the nova addresses, the key is the network name
+func ParseVMAddresses(addresses map[string]any) []VMAddress {
+	var vmAddrs []VMAddress
+	for network, v := range addresses {
+		addrList, ok := v.([]any)
+		if !ok {
+			continue
+		}
+
+		for _, a := range addrList {
+			addr, ok := a.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			vmAddr := VMAddress{
+				Network: network,
+				Addr:    fmt.Sprintf("%v", addr["addr"]),
+				Type:    "fixed",
+			}
+
+			if version, ok := addr["version"].(float64); ok {
+				vmAddr.Version = int(version)
+			} else if ip := net.ParseIP(vmAddr.Addr); ip != nil {
+				vmAddr.Version = 6
+				if ip.To4() != nil {
+					vmAddr.Version = 4
+				}
+			}
+
+			if ipType, ok := addr["OS-EXT-IPS:type"].(string); ok {
+				vmAddr.Type = ipType
+			}
+
+			vmAddrs = append(vmAddrs, vmAddr)
+		}
+	}
+
+	return vmAddrs
+}
+
+// Sort the addresses by the network preference, the network not in the list go last.
+// In the same network the ip version follow the versions order, then the fixed address come first since the tunnel host usually inside the cloud.
+// If network not empty only the addresses of that network are returned, the ip version not in versions are dropped
+func SortVMAddresses(addrs []VMAddress, preference []string, network string, versions []int) []VMAddress {
+	var sorted []VMAddress
+	for _, v := range addrs {
+		if (network == "" || v.Network == network) && slices.Contains(versions, v.Version) {
+			sorted = append(sorted, v)
+		}
+	}
+
+	rank := func(v VMAddress) int {
+		if index := slices.Index(preference, v.Network); index >= 0 {
+			return index
+		}
+		return len(preference)
+	}
+
+	sort.SliceStable(sorted, func(a, b int) bool {
+		if rank(sorted[a]) != rank(sorted[b]) {
+			return rank(sorted[a]) < rank(sorted[b])
+		}
+
+		if sorted[a].Network != sorted[b].Network {
+			return sorted[a].Network < sorted[b].Network
+		}
+
+		versionA, versionB := slices.Index(versions, sorted[a].Version), slices.Index(versions, sorted[b].Version)
+		if versionA != versionB {
+			return versionA < versionB
+		}
+
+		return sorted[a].Type == "fixed" && sorted[b].Type != "fixed"
+	})
+
+	return sorted
+}
+
+// Parse the ip versions order, e.g. 6,4 prefer ipv6 and fallback into ipv4
+func ParseIPVersions(spec string) ([]int, error) {
+	var versions []int
+	for _, v := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(v) {
+		case "4":
+			versions = append(versions, 4)
+		case "6":
+			versions = append(versions, 6)
+		default:
+			return nil, fmt.Errorf("unsupported ip version %q", v)
+		}
+	}
+	return versions, nil
+}
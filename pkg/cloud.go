@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var dnsUnsafe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// OpenStack cloud from clouds.yaml and the region, empty name mean use OS_CLOUD env
+type Cloud struct {
+	Name   string
+	Region string
+}
+
+// Parse clouds from "cloud/region,cloud/region" format, the region is optional.
+// Empty spec mean single cloud from OS_CLOUD and OS_REGION_NAME env
+func ParseClouds(spec string) ([]Cloud, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []Cloud{{}}, nil
+	}
+
+	var clouds []Cloud
+	seen := map[string]bool{}
+	for _, v := range strings.Split(spec, ",") {
+		name, region, _ := strings.Cut(strings.TrimSpace(v), "/")
+		if name == "" {
+			return nil, fmt.Errorf("invalid cloud %q, the format is cloud/region", v)
+		}
+
+		cloud := Cloud{Name: name, Region: region}
+		if seen[cloud.String()] {
+			return nil, fmt.Errorf("duplicate cloud %v", cloud)
+		}
+		seen[cloud.String()] = true
+
+		clouds = append(clouds, cloud)
+	}
+
+	return clouds, nil
+}
+
+// The cloud from OS_CLOUD and OS_REGION_NAME env if it is watched, otherwise the first cloud.
+// The tunnels stored before the clouds were configured belong to it
+func DefaultCloud(clouds []Cloud) Cloud {
+	envCloud := os.Getenv("OS_CLOUD")
+	envRegion := os.Getenv("OS_REGION_NAME")
+	for _, v := range clouds {
+		if v.Name == envCloud && (v.Region == envRegion || v.Region == "") {
+			return v
+		}
+	}
+	return clouds[0]
+}
+
+// Parse the url per cloud from "cloud/region=url,cloud/region=url" format, the single url
+// without cloud only allowed when one cloud watched
+func ParseCloudURLs(spec string, clouds []Cloud) (map[Cloud]string, error) {
+	urls := map[Cloud]string{}
+	if strings.TrimSpace(spec) == "" {
+		return urls, nil
+	}
+
+	watched := map[Cloud]bool{}
+	for _, v := range clouds {
+		watched[v] = true
+	}
+
+	for _, v := range strings.Split(spec, ",") {
+		v = strings.TrimSpace(v)
+		key, url, found := strings.Cut(v, "=")
+		if !found || strings.Contains(key, "://") {
+			if len(clouds) != 1 {
+				return nil, fmt.Errorf("the url %v must be set per cloud, e.g. cloud/region=url", v)
+			}
+			urls[clouds[0]] = v
+			continue
+		}
+
+		name, region, _ := strings.Cut(key, "/")
+		cloud := Cloud{Name: name, Region: region}
+		if !watched[cloud] {
+			return nil, fmt.Errorf("cloud %v of url is not watched", cloud)
+		}
+		urls[cloud] = url
+	}
+
+	return urls, nil
+}
+
+func (i Cloud) String() string {
+	if i.Name == "" && i.Region == "" {
+		return "default"
+	}
+	return fmt.Sprintf("%v/%v", i.Name, i.Region)
+}
+
+// DNS safe namespace of the cloud region, empty for the default cloud
+func (i Cloud) Namespace() string {
+	if i.Name == "" && i.Region == "" {
+		return ""
+	}
+
+	ns := strings.ToLower(strings.Trim(strings.Join([]string{i.Name, i.Region}, "-"), "-"))
+	return strings.Trim(dnsUnsafe.ReplaceAllString(ns, "-"), "-")
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/remoteconsoles"
+)
+
+// The browser console type of the protocol
+var consoleTypes = map[string]remoteconsoles.ConsoleType{
+	"vnc":   remoteconsoles.ConsoleTypeNoVNC,
+	"spice": remoteconsoles.ConsoleTypeSPICEHTML5,
+}
+
+// Get the remote console url of the vm, novnc for vnc and spice-html5 for spice
+func GetRemoteConsole(ctx context.Context, cmp *gophercloud.ServiceClient, vmID, protocol string) (string, error) {
+	consoleType, ok := consoleTypes[protocol]
+	if !ok {
+		return "", fmt.Errorf("unsupported console protocol %v", protocol)
+	}
+
+	console, err := remoteconsoles.Create(ctx, cmp, vmID, remoteconsoles.CreateOpts{
+		Protocol: remoteconsoles.ConsoleProtocol(protocol),
+		Type:     consoleType,
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+
+	return console.URL, nil
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+// The image and flavor rarely changed, so the property is cached to avoid the request on every check
+const propertyCacheTTL = 10 * time.Minute
+
+var (
+	propertyCache   = map[string]cachedProperty{}
+	propertyCacheMu sync.Mutex
+)
+
+type cachedProperty struct {
+	value   string
+	expires time.Time
+}
+
+// Get the glance image property, empty if the image or property not exist
+func GetImageProperty(ctx context.Context, cloud Cloud, imageID, key string) (string, error) {
+	return cacheProperty(fmt.Sprintf("%v/image/%v/%v", cloud, imageID, key), func() (string, error) {
+		client, err := InitImageClient(ctx, cloud)
+		if err != nil {
+			return "", err
+		}
+
+		image, err := images.Get(ctx, client, imageID).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if value, ok := image.Properties[key]; ok {
+			return fmt.Sprintf("%v", value), nil
+		}
+		return "", nil
+	})
+}
+
+// Get the flavor extra spec, empty if the flavor or extra spec not exist
+func GetFlavorExtraSpec(ctx context.Context, cloud Cloud, flavorID, key string) (string, error) {
+	return cacheProperty(fmt.Sprintf("%v/flavor/%v/%v", cloud, flavorID, key), func() (string, error) {
+		client, err := InitComputeClient(ctx, cloud)
+		if err != nil {
+			return "", err
+		}
+
+		spec, err := flavors.GetExtraSpec(ctx, client, flavorID, key).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		return spec[key], nil
+	})
+}
+
+func cacheProperty(key string, get func() (string, error)) (string, error) {
+	propertyCacheMu.Lock()
+	cached, ok := propertyCache[key]
+	propertyCacheMu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	value, err := get()
+	if err != nil {
+		return "", err
+	}
+
+	propertyCacheMu.Lock()
+	propertyCache[key] = cachedProperty{value: value, expires: time.Now().Add(propertyCacheTTL)}
+	propertyCacheMu.Unlock()
+
+	return value, nil
+}
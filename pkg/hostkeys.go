@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	fingerprintsBegin = "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+	fingerprintsEnd   = "-----END SSH HOST KEY FINGERPRINTS-----"
+	keysBegin         = "-----BEGIN SSH HOST KEY KEYS-----"
+	keysEnd           = "-----END SSH HOST KEY KEYS-----"
+)
+
+// The kernel timestamp and the ec2: prefix which cloud-init put in front of the console lines
+var consolePrefix = regexp.MustCompile(`^(\[\s*\d+\.\d+\]\s*)?(ec2:\s*)?`)
+
+// The preferred key type for the known_hosts line, the rsa key may too long for the property
+var hostKeyOrder = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA}
+
+// SSH host keys printed by cloud-init into the console, e.g. SHA256:abc (ED25519)
+type HostKeys struct {
+	Fingerprints []string
+	Keys         []ssh.PublicKey
+}
+
+// The console log lines read, cloud-init print the keys at the end of the boot so the tail is enough
+const consoleLogLines = 1000
+
+// Get the ssh host keys of the vm from the tail of nova console log
+func GetConsoleHostKeys(ctx context.Context, cmp *gophercloud.ServiceClient, vmID string) (HostKeys, error) {
+	output, err := servers.ShowConsoleOutput(ctx, cmp, vmID, servers.ShowConsoleOutputOpts{Length: consoleLogLines}).Extract()
+	if err != nil {
+		return HostKeys{}, err
+	}
+
+	return ParseHostKeys(output), nil
+}
+
+// Parse the ssh host key blocks of cloud-init from the console log, only the last boot is used
+func ParseHostKeys(consoleLog string) HostKeys {
+	var hostKeys HostKeys
+	block := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(consoleLog))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(consolePrefix.ReplaceAllString(strings.TrimSpace(scanner.Text()), ""))
+		switch line {
+		case fingerprintsBegin:
+			block = line
+			hostKeys.Fingerprints = nil
+			continue
+		case keysBegin:
+			block = line
+			hostKeys.Keys = nil
+			continue
+		case fingerprintsEnd, keysEnd:
+			block = ""
+			continue
+		}
+
+		switch block {
+		case fingerprintsBegin:
+			// 256 SHA256:abc root@vm (ED25519)
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && strings.HasPrefix(fields[1], "SHA256:") {
+				hostKeys.Fingerprints = append(hostKeys.Fingerprints, fields[1]+" "+fields[len(fields)-1])
+			}
+		case keysBegin:
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err == nil {
+				hostKeys.Keys = append(hostKeys.Keys, key)
+			}
+		}
+	}
+
+	// The fingerprints block is not printed by the old cloud-init
+	if len(hostKeys.Fingerprints) == 0 {
+		for _, key := range hostKeys.Keys {
+			hostKeys.Fingerprints = append(hostKeys.Fingerprints, ssh.FingerprintSHA256(key)+" ("+key.Type()+")")
+		}
+	}
+
+	return hostKeys
+}
+
+// Get the preferred host key, nil if no key found
+func (i HostKeys) PreferredKey() ssh.PublicKey {
+	for _, keyType := range hostKeyOrder {
+		index := slices.IndexFunc(i.Keys, func(key ssh.PublicKey) bool {
+			return key.Type() == keyType
+		})
+		if index >= 0 {
+			return i.Keys[index]
+		}
+	}
+	return nil
+}
+
+// Generate the known_hosts line of the key for the endpoint in host:port format
+func KnownHostsLine(endpoint string, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{endpoint}, key)
+}
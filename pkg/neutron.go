@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/ports"
+)
+
+// The router ports which the l3 agent plug into the qrouter namespace
+var routerInterfaceOwners = []string{
+	"network:router_interface",
+	"network:router_interface_distributed",
+	"network:ha_router_replicated_interface",
+}
+
+// Find the neutron namespaces which can reach the vm address, the qrouter namespaces of the
+// routers attached into the vm network then the qdhcp namespace of the network
+func FindVMNamespaces(ctx context.Context, network *gophercloud.ServiceClient, vmID string, addr VMAddress) ([]string, error) {
+	pages, err := ports.List(network, ports.ListOpts{DeviceID: vmID}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vmPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	// The floating ip is translated by the router, the namespace is the router of the fixed port network
+	var networkIDs []string
+	for _, port := range vmPorts {
+		for _, ip := range port.FixedIPs {
+			if (ip.IPAddress == addr.Addr || addr.Type == "floating") && !slices.Contains(networkIDs, port.NetworkID) {
+				networkIDs = append(networkIDs, port.NetworkID)
+			}
+		}
+	}
+
+	if len(networkIDs) == 0 {
+		return nil, fmt.Errorf("no port found for vm %v address %v", vmID, addr.Addr)
+	}
+
+	var namespaces []string
+	for _, networkID := range networkIDs {
+		pages, err := ports.List(network, ports.ListOpts{NetworkID: networkID}).AllPages(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		netPorts, err := ports.ExtractPorts(pages)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, port := range netPorts {
+			ns := "qrouter-" + port.DeviceID
+			if slices.Contains(routerInterfaceOwners, port.DeviceOwner) && !slices.Contains(namespaces, ns) {
+				namespaces = append(namespaces, ns)
+			}
+		}
+
+		namespaces = append(namespaces, "qdhcp-"+networkID)
+	}
+
+	return namespaces, nil
+}
@@ -0,0 +1,230 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/secgroups"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/ports"
+)
+
+// Parse the source address or cidr, single address become /32 or /128
+func ParseSource(source string) (*net.IPNet, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(source)
+	return cidr, err
+}
+
+// Check if the security groups of the vm ports already allow the source into the tcp port, the exclude group
+// is skipped. The port without security group is not filtered
+func SecGroupAllows(ctx context.Context, network *gophercloud.ServiceClient, vmID string, port int, source *net.IPNet, exclude string) (bool, error) {
+	pages, err := ports.List(network, ports.ListOpts{DeviceID: vmID}).AllPages(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	vmPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return false, err
+	}
+
+	var groupIDs []string
+	for _, v := range vmPorts {
+		if len(v.SecurityGroups) == 0 {
+			return true, nil
+		}
+
+		for _, id := range v.SecurityGroups {
+			if id != exclude && !slices.Contains(groupIDs, id) {
+				groupIDs = append(groupIDs, id)
+			}
+		}
+	}
+
+	for _, id := range groupIDs {
+		pages, err := rules.List(network, rules.ListOpts{SecGroupID: id, Direction: string(rules.DirIngress)}).AllPages(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		groupRules, err := rules.ExtractRules(pages)
+		if err != nil {
+			return false, err
+		}
+
+		for _, rule := range groupRules {
+			if ruleAllows(rule, port, source) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func ruleAllows(rule rules.SecGroupRule, port int, source *net.IPNet) bool {
+	if rule.EtherType != etherType(source) || (rule.Protocol != "" && rule.Protocol != "tcp" && rule.Protocol != "6") {
+		return false
+	}
+
+	if rule.PortRangeMin != 0 && (port < rule.PortRangeMin || port > rule.PortRangeMax) {
+		return false
+	}
+
+	// The remote group only match the members, the tunnel host never member of it
+	if rule.RemoteGroupID != "" {
+		return false
+	}
+
+	if rule.RemoteIPPrefix == "" {
+		return true
+	}
+
+	_, prefix, err := net.ParseCIDR(rule.RemoteIPPrefix)
+	if err != nil {
+		return false
+	}
+
+	ones, _ := prefix.Mask.Size()
+	sourceOnes, _ := source.Mask.Size()
+	return prefix.Contains(source.IP) && ones <= sourceOnes
+}
+
+func etherType(source *net.IPNet) string {
+	if source.IP.To4() != nil {
+		return string(rules.EtherType4)
+	}
+	return string(rules.EtherType6)
+}
+
+// Get the security group id by name in the project, empty if not exist
+func FindSecGroup(ctx context.Context, network *gophercloud.ServiceClient, projectID, name string) (string, error) {
+	pages, err := groups.List(network, groups.ListOpts{Name: name, ProjectID: projectID}).AllPages(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	found, err := groups.ExtractGroups(pages)
+	if err != nil || len(found) == 0 {
+		return "", err
+	}
+
+	return found[0].ID, nil
+}
+
+// Get the security group by name in the vm project and attach it into the vm, create it if not exist
+func EnsureSecGroup(ctx context.Context, network, compute *gophercloud.ServiceClient, vmID, projectID, name string) (string, error) {
+	groupID, err := FindSecGroup(ctx, network, projectID, name)
+	if err != nil {
+		return "", err
+	}
+
+	if groupID == "" {
+		log.Printf("Create security group, name=%v project=%v", name, projectID)
+		group, err := groups.Create(ctx, network, groups.CreateOpts{
+			Name:        name,
+			ProjectID:   projectID,
+			Description: "Managed by openstack tunnel service, allow the tunnel host into the vm services",
+		}).Extract()
+		if err != nil {
+			return "", err
+		}
+		groupID = group.ID
+
+		// The new group come with allow all egress rules only, nothing to clean
+	}
+
+	// Attach by id since the group name not unique across projects, nova accept both
+	err = secgroups.AddServer(ctx, compute, vmID, groupID).ExtractErr()
+	if err != nil && !gophercloud.ResponseCodeIs(err, http.StatusConflict) {
+		return "", err
+	}
+
+	return groupID, nil
+}
+
+// Create the ingress rule from the source into the tcp port, return the existing rule id if the same rule already exist.
+// The created is false for the existing rule
+func CreateSecGroupRule(ctx context.Context, network *gophercloud.ServiceClient, groupID string, port int, source *net.IPNet) (string, bool, error) {
+	opts := rules.CreateOpts{
+		Direction:      rules.DirIngress,
+		EtherType:      rules.RuleEtherType(etherType(source)),
+		SecGroupID:     groupID,
+		PortRangeMin:   port,
+		PortRangeMax:   port,
+		Protocol:       rules.ProtocolTCP,
+		RemoteIPPrefix: source.String(),
+		Description:    "Managed by openstack tunnel service",
+	}
+
+	rule, err := rules.Create(ctx, network, opts).Extract()
+	if err == nil {
+		log.Printf("Create security group rule, group=%v port=%v source=%v id=%v", groupID, port, source, rule.ID)
+		return rule.ID, true, nil
+	}
+
+	if !gophercloud.ResponseCodeIs(err, http.StatusConflict) {
+		return "", false, err
+	}
+
+	pages, err := rules.List(network, rules.ListOpts{
+		SecGroupID:     groupID,
+		Direction:      string(rules.DirIngress),
+		PortRangeMin:   port,
+		PortRangeMax:   port,
+		RemoteIPPrefix: source.String(),
+	}).AllPages(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	existing, err := rules.ExtractRules(pages)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(existing) == 0 {
+		return "", false, fmt.Errorf("security group rule conflict but not found, group=%v port=%v", groupID, port)
+	}
+
+	return existing[0].ID, false, nil
+}
+
+// Delete the security group rule, the rule already deleted is ignored
+func DeleteSecGroupRule(ctx context.Context, network *gophercloud.ServiceClient, ruleID string) error {
+	log.Printf("Delete security group rule, id=%v", ruleID)
+	err := rules.Delete(ctx, network, ruleID).ExtractErr()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Detach the security group from the vm and delete it, the vm can be already deleted
+func DeleteSecGroup(ctx context.Context, network, compute *gophercloud.ServiceClient, vmID, groupID string) error {
+	err := secgroups.RemoveServer(ctx, compute, vmID, groupID).ExtractErr()
+	if err != nil && !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return err
+	}
+
+	log.Printf("Delete security group, id=%v", groupID)
+	err = groups.Delete(ctx, network, groupID).ExtractErr()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/loadbalancer/v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/ports"
+)
+
+const (
+	TargetPort         = "port"
+	TargetLoadBalancer = "loadbalancer"
+)
+
+// Neutron reject the tag longer than 60 characters
+const maxPortTagLen = 60
+
+// Resource other than server which can be tunneled, the tunnel requested and published with the resource tags
+type Target struct {
+	Kind      string
+	ID        string
+	Name      string
+	ProjectID string
+	Addrs     []VMAddress
+	Tags      []string
+}
+
+// List the neutron ports and octavia load balancers which have any of the tags, only of the project unless empty.
+// The cloud without octavia only return the ports
+func ListTaggedTargets(ctx context.Context, cloud Cloud, tags []string, projectID string) ([]Target, error) {
+	var targets []Target
+
+	networkClient, err := InitNetworkClient(ctx, cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := ports.List(networkClient, ports.ListOpts{TagsAny: strings.Join(tags, ","), ProjectID: projectID}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	taggedPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, port := range taggedPorts {
+		targets = append(targets, portTarget(port))
+	}
+
+	lbClient, err := InitLoadBalancerClient(ctx, cloud)
+	if err != nil {
+		// Octavia is optional
+		return targets, nil
+	}
+
+	pages, err = loadbalancers.List(lbClient, loadbalancers.ListOpts{TagsAny: tags, ProjectID: projectID}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lbs, err := loadbalancers.ExtractLoadBalancers(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lb := range lbs {
+		targets = append(targets, lbTarget(lb))
+	}
+
+	return targets, nil
+}
+
+// Get the target by id, nil if already deleted
+func GetTarget(ctx context.Context, cloud Cloud, kind, id string) (*Target, error) {
+	switch kind {
+	case TargetPort:
+		networkClient, err := InitNetworkClient(ctx, cloud)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := ports.Get(ctx, networkClient, id).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		target := portTarget(*port)
+		return &target, nil
+
+	case TargetLoadBalancer:
+		lbClient, err := InitLoadBalancerClient(ctx, cloud)
+		if err != nil {
+			return nil, err
+		}
+
+		lb, err := loadbalancers.Get(ctx, lbClient, id).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		target := lbTarget(*lb)
+		return &target, nil
+	}
+
+	return nil, fmt.Errorf("unsupported target %v", kind)
+}
+
+func portTarget(port ports.Port) Target {
+	target := Target{
+		Kind:      TargetPort,
+		ID:        port.ID,
+		Name:      port.Name,
+		ProjectID: port.ProjectID,
+		Tags:      port.Tags,
+	}
+
+	for _, ip := range port.FixedIPs {
+		target.Addrs = append(target.Addrs, targetAddress(port.NetworkID, ip.IPAddress))
+	}
+	return target
+}
+
+func lbTarget(lb loadbalancers.LoadBalancer) Target {
+	return Target{
+		Kind:      TargetLoadBalancer,
+		ID:        lb.ID,
+		Name:      lb.Name,
+		ProjectID: lb.ProjectID,
+		Tags:      lb.Tags,
+		Addrs:     []VMAddress{targetAddress(lb.VipNetworkID, lb.VipAddress)},
+	}
+}
+
+func targetAddress(network, addr string) VMAddress {
+	vmAddr := VMAddress{Network: network, Addr: addr, Version: 4, Type: "fixed"}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		vmAddr.Version = 6
+	}
+	return vmAddr
+}
+
+// Replace the tag which start with the prefix, empty value only remove the tag
+func SetTargetTag(ctx context.Context, cloud Cloud, target *Target, prefix, value string) error {
+	tags := slices.DeleteFunc(slices.Clone(target.Tags), func(tag string) bool {
+		return strings.HasPrefix(tag, prefix)
+	})
+	if value != "" {
+		tag := prefix + value
+		if target.Kind == TargetPort && len(tag) > maxPortTagLen {
+			return fmt.Errorf("tag %v too long for neutron port %v", tag, target.ID)
+		}
+		tags = append(tags, tag)
+	}
+
+	if slices.Equal(tags, target.Tags) {
+		return nil
+	}
+
+	switch target.Kind {
+	case TargetPort:
+		networkClient, err := InitNetworkClient(ctx, cloud)
+		if err != nil {
+			return err
+		}
+
+		_, err = attributestags.ReplaceAll(ctx, networkClient, "ports", target.ID, attributestags.ReplaceAllOpts{Tags: tags}).Extract()
+		if err != nil {
+			return err
+		}
+
+	case TargetLoadBalancer:
+		lbClient, err := InitLoadBalancerClient(ctx, cloud)
+		if err != nil {
+			return err
+		}
+
+		_, err = loadbalancers.Update(ctx, lbClient, target.ID, loadbalancers.UpdateOpts{Tags: &tags}).Extract()
+		if err != nil {
+			return err
+		}
+	}
+
+	target.Tags = tags
+	return nil
+}
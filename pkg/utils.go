@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"regexp"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
@@ -14,28 +16,51 @@ import (
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
 	"github.com/gophercloud/gophercloud/v2/openstack/config"
 	"github.com/gophercloud/gophercloud/v2/openstack/config/clouds"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+	"github.com/justhumanz/openstack-tunnel-as-service/internal/pkg/dialer"
 )
 
-const ipv4Regex = `\b(?:\d{1,3}\.){3}\d{1,3}\b`
 const tcpTimeout = 3 * time.Second
 
-func FindVMactiveIP(vmIps string, vmSvc int) (string, error) {
-	ips := regexp.MustCompile(ipv4Regex).FindAllString(vmIps, -1)
-	for _, ip := range ips {
-		vmIp := fmt.Sprintf("%v:%v", ip, vmSvc)
+const (
+	maxRetries     = 5
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+var (
+	providerClients = map[Cloud]cloudClient{}
+	computeClients  = map[Cloud]*gophercloud.ServiceClient{}
+	networkClients  = map[Cloud]*gophercloud.ServiceClient{}
+	imageClients    = map[Cloud]*gophercloud.ServiceClient{}
+	lbClients       = map[Cloud]*gophercloud.ServiceClient{}
+	clientMu        sync.Mutex
+)
+
+type cloudClient struct {
+	provider *gophercloud.ProviderClient
+	endpoint gophercloud.EndpointOpts
+}
+
+// Try connect into the vm service by the addresses order with the dialer, return the first reachable address
+func FindVMactiveIP(d dialer.Dialer, addrs []VMAddress, vmSvc int) (VMAddress, error) {
+	for _, addr := range addrs {
+		vmIp := net.JoinHostPort(addr.Addr, strconv.Itoa(vmSvc))
 		//fmt.Println("Try connection into:", vmIp)
 
-		conn, err := net.DialTimeout("tcp", vmIp, tcpTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), tcpTimeout)
+		conn, err := d.DialContext(ctx, "tcp", vmIp)
+		cancel()
 		if err != nil {
 			//fmt.Println("TCP connection failed:", err)
 			continue
 		}
 
 		defer conn.Close()
-		return ip, nil
+		return addr, nil
 	}
 
-	return "", errors.New("VM service unreachable")
+	return VMAddress{}, errors.New("VM service unreachable")
 }
 
 func Difference(a, b []string) []string {
@@ -53,22 +78,222 @@ func Difference(a, b []string) []string {
 	return diff
 }
 
-func InitComputeClient(ctx context.Context) *gophercloud.ServiceClient {
-	authOptions, endpointOptions, tlsConfig, err := clouds.Parse()
+// Get the compute client of the cloud, the client only authenticated once and shared.
+// The token renewed automatically on 401 and the request retried with backoff on 5xx
+func InitComputeClient(ctx context.Context, cloud Cloud) (*gophercloud.ServiceClient, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client, ok := computeClients[cloud]; ok {
+		return client, nil
+	}
+
+	c, err := initProviderClient(ctx, cloud)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	providerClient, err := config.NewProviderClient(ctx, authOptions, config.WithTLSConfig(tlsConfig))
+	computeClient, err := openstack.NewComputeV2(c.provider, c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// The server tags only returned since 2.26
+	computeClient.Microversion = "2.26"
+
+	computeClients[cloud] = computeClient
+	return computeClient, nil
+}
+
+// Get the neutron client of the cloud, share the same authenticated provider client with compute
+func InitNetworkClient(ctx context.Context, cloud Cloud) (*gophercloud.ServiceClient, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client, ok := networkClients[cloud]; ok {
+		return client, nil
+	}
+
+	c, err := initProviderClient(ctx, cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	networkClient, err := openstack.NewNetworkV2(c.provider, c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	networkClients[cloud] = networkClient
+	return networkClient, nil
+}
+
+// Get the glance client of the cloud, share the same authenticated provider client with compute
+func InitImageClient(ctx context.Context, cloud Cloud) (*gophercloud.ServiceClient, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client, ok := imageClients[cloud]; ok {
+		return client, nil
+	}
+
+	c, err := initProviderClient(ctx, cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	imageClient, err := openstack.NewImageV2(c.provider, c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	imageClients[cloud] = imageClient
+	return imageClient, nil
+}
+
+// Get the octavia client of the cloud, share the same authenticated provider client with compute
+func InitLoadBalancerClient(ctx context.Context, cloud Cloud) (*gophercloud.ServiceClient, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client, ok := lbClients[cloud]; ok {
+		return client, nil
+	}
+
+	c, err := initProviderClient(ctx, cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	lbClient, err := openstack.NewLoadBalancerV2(c.provider, c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	lbClients[cloud] = lbClient
+	return lbClient, nil
+}
+
+// The token of the cloud credential, created or reused
+type tokenResult interface {
+	ExtractProject() (*tokens.Project, error)
+	ExtractUser() (*tokens.User, error)
+}
+
+func getToken(ctx context.Context, cloud Cloud) (tokenResult, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	c, err := initProviderClient(ctx, cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := c.provider.GetAuthResult().(type) {
+	case tokens.CreateResult:
+		return r, nil
+	case tokens.GetResult:
+		return r, nil
+	}
+	return nil, fmt.Errorf("can't get the token of cloud %v", cloud)
+}
+
+// Get the user of the cloud credential from the token
+func GetUserID(ctx context.Context, cloud Cloud) (string, error) {
+	token, err := getToken(ctx, cloud)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := token.ExtractUser()
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// Get the project of the cloud credential from the token
+func GetProjectID(ctx context.Context, cloud Cloud) (string, error) {
+	token, err := getToken(ctx, cloud)
+	if err != nil {
+		return "", err
+	}
+
+	project, err := token.ExtractProject()
+	if err != nil {
+		return "", err
+	}
+
+	if project == nil {
+		return "", fmt.Errorf("the credential of cloud %v not scoped into a project", cloud)
+	}
+	return project.ID, nil
+}
+
+// Must be called with clientMu locked
+func initProviderClient(ctx context.Context, cloud Cloud) (cloudClient, error) {
+	if c, ok := providerClients[cloud]; ok {
+		return c, nil
+	}
+
+	var opts []clouds.ParseOption
+	if cloud.Name != "" {
+		opts = append(opts, clouds.WithCloudName(cloud.Name))
+	}
+	if cloud.Region != "" {
+		opts = append(opts, clouds.WithRegion(cloud.Region))
+	}
+
+	authOptions, endpointOptions, tlsConfig, err := clouds.Parse(opts...)
 	if err != nil {
-		panic(err)
+		return cloudClient{}, err
 	}
+	authOptions.AllowReauth = true
 
-	computeClient, err := openstack.NewComputeV2(providerClient, endpointOptions)
+	providerClient, err := config.NewProviderClient(ctx, authOptions, config.WithTLSConfig(tlsConfig))
 	if err != nil {
-		panic(err)
+		return cloudClient{}, err
+	}
+
+	providerClient.RetryFunc = retryRequest
+	providerClient.RetryBackoffFunc = retryBackoff
+	providerClient.MaxBackoffRetries = maxRetries
+
+	c := cloudClient{
+		provider: providerClient,
+		endpoint: endpointOptions,
+	}
+	providerClients[cloud] = c
+	return c, nil
+}
+
+// Retry the request on 5xx and network error, other errors returned into the caller
+func retryRequest(ctx context.Context, method, url string, options *gophercloud.RequestOpts, err error, failCount uint) error {
+	var respErr gophercloud.ErrUnexpectedResponseCode
+	var netErr net.Error
+
+	retryable := errors.As(err, &netErr) || (errors.As(err, &respErr) && respErr.Actual >= http.StatusInternalServerError)
+	if !retryable || failCount > maxRetries {
+		return err
+	}
+
+	log.Printf("OpenStack request failed, retry %v/%v, method=%v url=%v %v", failCount, maxRetries, method, url, err)
+	return sleepBackoff(ctx, failCount)
+}
+
+// Retry the request on 429
+func retryBackoff(ctx context.Context, respErr *gophercloud.ErrUnexpectedResponseCode, err error, failCount uint) error {
+	log.Printf("OpenStack request rate limited, retry %v/%v, url=%v", failCount, maxRetries, respErr.URL)
+	return sleepBackoff(ctx, failCount)
+}
+
+func sleepBackoff(ctx context.Context, failCount uint) error {
+	backoff := min(retryBaseDelay<<(failCount-1), retryMaxDelay)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(backoff):
+		return nil
 	}
-	return computeClient
 }
 
 func UpdateCmpProperty(cmp *gophercloud.ServiceClient, vm servers.Server, key, value string) error {
@@ -81,9 +306,19 @@ func UpdateCmpProperty(cmp *gophercloud.ServiceClient, vm servers.Server, key, v
 	return nil
 }
 
-func RemoveCmpProperty(cmp *gophercloud.ServiceClient, vmid, metadata string) {
+// Update several properties with one request
+func UpdateCmpProperties(cmp *gophercloud.ServiceClient, vm servers.Server, properties map[string]string) error {
+	log.Printf("Update vm properties, name=%v id=%v properties=%v", vm.Name, vm.ID, properties)
+	r := servers.UpdateMetadata(context.Background(), cmp, vm.ID, servers.MetadataOpts(properties))
+	return r.Err
+}
+
+func RemoveCmpProperty(cmp *gophercloud.ServiceClient, vmid, metadata string) error {
 	r := servers.DeleteMetadatum(context.Background(), cmp, vmid, metadata)
-	if r.Err != nil {
-		log.Fatal(r.Err)
+	// The property already removed
+	if gophercloud.ResponseCodeIs(r.Err, http.StatusNotFound) {
+		return nil
 	}
+
+	return r.Err
 }